@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// Kinds of entries in an action log.
+const (
+	// a new game, with its id, settings and clock
+	LOG_CREATE = "create"
+	// a game brought back from a checkpoint, replacing everything logged before
+	LOG_RESTORE = "restore"
+	LOG_CODE    = "code"
+	LOG_JOIN    = "join"
+	// the server starting a full public lobby, with the game clock it started at
+	LOG_START = "start"
+	// the start of a simulation step, setting the game clock
+	LOG_TICK       = "tick"
+	LOG_CLOCK      = "clock"
+	LOG_ACTION     = "action"
+	LOG_DISCONNECT = "disconnect"
+	// the end of a simulation step, with a hash of the resulting state
+	LOG_STEP = "step"
+)
+
+// logEntry records one change to a game, in the order changes were made
+type logEntry struct {
+	Kind       string
+	GameId     string          `json:",omitempty"`
+	Settings   *GameSettings   `json:",omitempty"`
+	Checkpoint json.RawMessage `json:",omitempty"`
+	Code       string          `json:",omitempty"`
+	Player     *Player         `json:",omitempty"`
+	PlayerId   string          `json:",omitempty"`
+	Tick       uint64          `json:",omitempty"`
+	Now        *Time           `json:",omitempty"`
+	Offset     time.Duration   `json:",omitempty"`
+	RoundTrip  time.Duration   `json:",omitempty"`
+	Action     *Action         `json:",omitempty"`
+	Rejections []Rejection     `json:",omitempty"`
+	// seed of the random choices made when the game started during this entry
+	Seed *int64        `json:",omitempty"`
+	Dt   time.Duration `json:",omitempty"`
+	Hash string        `json:",omitempty"`
+}
+
+// actionLog appends the entries of one game to a file, one JSON object per line
+type actionLog struct {
+	file *os.File
+	w    *bufio.Writer
+	enc  *json.Encoder
+}
+
+// openActionLog opens the log of a game for appending, creating it if needed
+func openActionLog(dir string, gameId string) (*actionLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, gameId+".jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(file)
+	return &actionLog{file: file, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (l *actionLog) append(e *logEntry) error {
+	return l.enc.Encode(e)
+}
+
+func (l *actionLog) flush() error {
+	return l.w.Flush()
+}
+
+func (l *actionLog) close() error {
+	if err := l.w.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// record appends an entry to the game's log, if it keeps one, assuming the lock is held
+func (g *game) record(e *logEntry) {
+	e.Seed, g.startSeed = g.startSeed, nil
+
+	if g.log == nil {
+		return
+	}
+
+	if g.tickPending {
+		g.logTick()
+	}
+	g.write(e)
+}
+
+// logTick appends the start of the current step, assuming the lock is held
+func (g *game) logTick() {
+	g.tickPending = false
+	g.write(&logEntry{Kind: LOG_TICK, Tick: g.simTick, Now: &Time{g.now}})
+}
+
+func (g *game) write(e *logEntry) {
+	if g.log == nil {
+		return
+	}
+
+	if err := g.log.append(e); err != nil {
+		ErrorLogger.Println("Failed to write action log, no longer logging game:", g.GameId, err)
+		g.log.close()
+		g.log = nil
+	}
+}
+
+// flushLog writes out the entries logged so far, assuming the lock is held
+func (g *game) flushLog() {
+	if g.log == nil {
+		return
+	}
+
+	if err := g.log.flush(); err != nil {
+		ErrorLogger.Println("Failed to write action log, no longer logging game:", g.GameId, err)
+		g.log.close()
+		g.log = nil
+	}
+}
+
+// closeLog stops logging the game once its loop is over
+func (g *game) closeLog() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.log == nil {
+		return
+	}
+
+	if err := g.log.close(); err != nil {
+		ErrorLogger.Println("Failed to close action log:", g.GameId, err)
+	}
+	g.log = nil
+}
+
+// stateHash fingerprints everything the rules depend on, assuming the lock is held
+func (g *game) stateHash() (string, error) {
+	state := g.GameState
+	// the timestamp is only set for clients, with the wall clock
+	state.Timestamp = nil
+
+	msg, err := json.Marshal(struct {
+		State     GameState
+		KillReady map[string]time.Time
+	}{state, g.killReady})
+	if err != nil {
+		return "", err
+	}
+
+	h := fnv.New64a()
+	h.Write(msg)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// replayGame rebuilds a game from its log, checking every step against the state the live game reached
+func replayGame(r io.Reader) (*game, int, error) {
+	var g *game
+	d := json.NewDecoder(r)
+
+	n := 0
+	for ; ; n++ {
+		var e logEntry
+		if err := d.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return g, n, fmt.Errorf("entry %d: %v", n, err)
+		}
+
+		if g == nil && e.Kind != LOG_CREATE && e.Kind != LOG_RESTORE {
+			return g, n, fmt.Errorf("entry %d: %s before the game was created", n, e.Kind)
+		}
+		if g != nil {
+			g.replaySeed = e.Seed
+		}
+
+		switch e.Kind {
+		case LOG_CREATE:
+			if e.Settings == nil || e.Now == nil {
+				return g, n, fmt.Errorf("entry %d: incomplete create", n)
+			}
+			g = blankGame(nil, *e.Settings, DEFAULT_TIMING)
+			g.GameId = e.GameId
+			g.now = e.Now.Time
+			g.addTasks()
+		case LOG_RESTORE:
+			var cp checkpoint
+			if err := json.Unmarshal(e.Checkpoint, &cp); err != nil {
+				return g, n, fmt.Errorf("entry %d: %v", n, err)
+			}
+			g = blankGame(nil, cp.State.Settings, DEFAULT_TIMING)
+			g.applyCheckpoint(&cp)
+			if e.Now != nil {
+				g.now = e.Now.Time
+			}
+		case LOG_CODE:
+			g.setCode(e.Code)
+		case LOG_JOIN:
+			if e.Player == nil {
+				return g, n, fmt.Errorf("entry %d: join without player", n)
+			}
+			if err := g.addPlayer(e.Player); err != nil {
+				return g, n, fmt.Errorf("entry %d: %v", n, err)
+			}
+		case LOG_START:
+			if e.Now == nil {
+				return g, n, fmt.Errorf("entry %d: start without time", n)
+			}
+			g.simTick = e.Tick
+			g.now = e.Now.Time
+			g.start()
+		case LOG_TICK:
+			if e.Now == nil {
+				return g, n, fmt.Errorf("entry %d: tick without time", n)
+			}
+			g.simTick = e.Tick
+			g.now = e.Now.Time
+		case LOG_CLOCK:
+			g.updateClock(e.PlayerId, e.Offset, e.RoundTrip)
+		case LOG_ACTION:
+			if e.Action == nil {
+				return g, n, fmt.Errorf("entry %d: action missing", n)
+			}
+			rejections := g.performAction(e.Action)
+			if len(rejections) != len(e.Rejections) || (len(rejections) > 0 && !reflect.DeepEqual(rejections, e.Rejections)) {
+				return g, n, fmt.Errorf("entry %d: tick %d: action of %s rejected with %v, but the log has %v",
+					n, g.simTick, e.Action.PlayerId, rejections, e.Rejections)
+			}
+			g.checkEndOfGame()
+		case LOG_DISCONNECT:
+			g.disconnectPlayer(e.PlayerId)
+			g.checkEndOfGame()
+		case LOG_STEP:
+			g.advance(e.Dt)
+			hash, err := g.stateHash()
+			if err != nil {
+				return g, n, fmt.Errorf("entry %d: %v", n, err)
+			}
+			if hash != e.Hash {
+				return g, n, fmt.Errorf("entry %d: state diverged at tick %d", n, g.simTick)
+			}
+		default:
+			return g, n, fmt.Errorf("entry %d: unknown kind %q", n, e.Kind)
+		}
+	}
+
+	if g == nil {
+		return nil, n, fmt.Errorf("empty log")
+	}
+	return g, n, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// playLoggedGame plays a short game with logging on, started by the given function once
+// the lobby has idled for a while, and returns the game once its loop has quit
+func playLoggedGame(t *testing.T, start func(g *game)) (*game, string) {
+	dir := t.TempDir()
+	toserver := make(chan *serverUpdate, 16)
+	go func() {
+		for range toserver {
+		}
+	}()
+
+	settings := DEFAULT_SETTINGS
+	settings.MinPlayers = 3
+	settings.MaxPlayers = 4
+	settings.NumImpostors = 1
+	settings.AuthoritativeMovement = true
+
+	g, err := newGame(toserver, settings, loopTiming{TickRate: 60, SnapshotRate: 20}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	playerIds := make([]string, 0, settings.MaxPlayers)
+	for i := 0; i < settings.MaxPlayers; i++ {
+		p := newPlayer("player")
+		if err := g.addPlayer(p); err != nil {
+			t.Fatal(err)
+		}
+		playerIds = append(playerIds, p.PlayerId)
+	}
+
+	// steps of an idle lobby are not logged, which the start must not depend on
+	time.Sleep(100 * time.Millisecond)
+	start(g)
+	time.Sleep(50 * time.Millisecond)
+
+	for i, playerId := range playerIds {
+		g.inputs.push(&gameUpdate{action: &Action{
+			PlayerId:  playerId,
+			Input:     &Vector{X: 1, Y: float64(i) - 1},
+			InputSeq:  1,
+			Timestamp: Time{time.Now()},
+		}})
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the loop closes the log last thing before returning
+	g.inbox <- &gameUpdate{quit: true}
+	for closed := false; !closed; {
+		time.Sleep(10 * time.Millisecond)
+		g.mu.RLock()
+		closed = g.log == nil
+		g.mu.RUnlock()
+	}
+
+	return g, filepath.Join(dir, g.GameId+".jsonl")
+}
+
+// checkReplay replays the log of a game and compares the state it ends in with the game's
+func checkReplay(t *testing.T, g *game, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	replayed, _, err := replayGame(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.Status != IN_PROGRESS {
+		t.Fatalf("game did not start: status %d", g.Status)
+	}
+
+	want, err := g.stateHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := replayed.stateHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("replay ended in a different state at tick %d", replayed.simTick)
+	}
+}
+
+// TestReplayServerStart replays a game the server started once its lobby was full
+func TestReplayServerStart(t *testing.T) {
+	g, path := playLoggedGame(t, func(g *game) {
+		g.start()
+	})
+	checkReplay(t, g, path)
+}
+
+// TestReplayHostStart replays a game its host started
+func TestReplayHostStart(t *testing.T) {
+	g, path := playLoggedGame(t, func(g *game) {
+		g.mu.RLock()
+		hostId := g.HostId
+		g.mu.RUnlock()
+
+		g.inputs.push(&gameUpdate{action: &Action{PlayerId: hostId, StartGame: true, Timestamp: Time{time.Now()}}})
+	})
+	checkReplay(t, g, path)
+}
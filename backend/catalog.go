@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// catalogEntry is a server as listed by the catalog, with the address its announcement came from
+type catalogEntry struct {
+	CatalogAnnounce
+	Address   string `json:"address"`
+	LastHeard int64  `json:"lastheard"`
+}
+
+// catalog collects the announcements of game servers and lists them over HTTP,
+// standing in for the ND CSE name server
+type catalog struct {
+	entries  map[string]*catalogEntry
+	lifetime time.Duration
+	mu       sync.Mutex
+	serveMux http.ServeMux
+}
+
+func newCatalog(lifetime time.Duration) *catalog {
+	c := &catalog{
+		entries:  make(map[string]*catalogEntry),
+		lifetime: lifetime,
+	}
+	c.serveMux.HandleFunc("/query.json", c.queryHandler)
+
+	return c
+}
+
+// ServeHTTP implements the required interface for an http server
+func (c *catalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.serveMux.ServeHTTP(w, r)
+}
+
+// listen records every announcement received until the connection is closed
+func (c *catalog) listen(conn net.PacketConn) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var a CatalogAnnounce
+		if err := json.Unmarshal(buf[:n], &a); err != nil {
+			WarnLogger.Println("Catalog received invalid announcement from", addr, err)
+			continue
+		}
+
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			WarnLogger.Println("Catalog could not parse address", addr, err)
+			continue
+		}
+
+		c.record(host, &a, time.Now())
+	}
+}
+
+func catalogKey(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// record adds or refreshes a server, or drops it when it deregisters
+func (c *catalog) record(host string, a *CatalogAnnounce, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := catalogKey(host, a.Port)
+	if a.Deregister {
+		InfoLogger.Println("Catalog deregistered:", key)
+		delete(c.entries, key)
+		return
+	}
+
+	if _, ok := c.entries[key]; !ok {
+		InfoLogger.Println("Catalog registered:", key, a.Project)
+	}
+	c.entries[key] = &catalogEntry{
+		CatalogAnnounce: *a,
+		Address:         host,
+		LastHeard:       now.Unix(),
+	}
+}
+
+// remove drops a server, such as one that stopped answering
+func (c *catalog) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+// list drops the servers not heard from in too long and returns the others, in a stable order
+func (c *catalog) list(now time.Time) []*catalogEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.listLocked(now)
+}
+
+// listLocked is list, assuming the lock is held; entries are never modified in place,
+// so they may still be read once the lock is released
+func (c *catalog) listLocked(now time.Time) []*catalogEntry {
+	entries := make([]*catalogEntry, 0, len(c.entries))
+	for key, entry := range c.entries {
+		if now.Sub(time.Unix(entry.LastHeard, 0)) > c.lifetime {
+			InfoLogger.Println("Catalog expired:", key)
+			delete(c.entries, key)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Address != entries[j].Address {
+			return entries[i].Address < entries[j].Address
+		}
+		return entries[i].Port < entries[j].Port
+	})
+
+	return entries
+}
+
+// queryHandler serves the list of live servers as JSON
+func (c *catalog) queryHandler(w http.ResponseWriter, r *http.Request) {
+	msg, err := json.Marshal(c.list(time.Now()))
+	if err != nil {
+		ErrorLogger.Println("Catalog failed to marshall entries:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the frontend is served from another origin
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(msg)
+}
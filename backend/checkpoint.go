@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// checkpoint is what is saved of a game in progress, enough to carry on after the server restarts
+type checkpoint struct {
+	State     GameState
+	KillReady map[string]time.Time
+	Tick      uint64
+	// resume tokens of the players, so they can reconnect to the restored game
+	Tokens map[string]string
+	Saved  time.Time
+}
+
+// checkpoint marshals the state of a game in progress, or returns nil if there is nothing worth saving
+func (g *game) checkpoint(tokens map[string]string) ([]byte, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.Status != IN_PROGRESS && g.Status != MEETING {
+		return nil, nil
+	}
+
+	// the clock of a paused game stopped when it was paused
+	saved := time.Now()
+	if !g.pausedAt.IsZero() {
+		saved = g.pausedAt
+	}
+
+	return json.Marshal(checkpoint{
+		State:     g.GameState,
+		KillReady: g.killReady,
+		Tick:      g.tick,
+		Tokens:    tokens,
+		Saved:     saved,
+	})
+}
+
+// restoreGame brings a saved game back, as if it had been paused since it was saved, and keeps
+// it paused until resume is called; its actions are logged to logDir unless it is empty
+func restoreGame(toserver chan *serverUpdate, cp *checkpoint, timing loopTiming, logDir string) (*game, error) {
+	if err := cp.State.Settings.validate(); err != nil {
+		return nil, err
+	}
+
+	g := blankGame(toserver, cp.State.Settings, timing)
+	g.applyCheckpoint(cp)
+	g.now = serverNow()
+	g.shiftTimes(g.now.Sub(cp.Saved).Truncate(time.Microsecond))
+	g.pausedAt = g.now
+
+	// players without a resume token have no way back into the game
+	for playerId, player := range g.Players {
+		if _, ok := cp.Tokens[playerId]; !ok {
+			player.IsConnected = false
+		}
+	}
+
+	if logDir != "" {
+		log, err := openActionLog(logDir, g.GameId)
+		if err != nil {
+			return nil, err
+		}
+		g.log = log
+	}
+
+	return g, nil
+}
+
+// resume starts the loop of a restored game, carrying on from where it was paused
+func (g *game) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.pausedAt.IsZero() {
+		return
+	}
+
+	now := serverNow()
+	g.shiftTimes(now.Sub(g.pausedAt))
+	g.now = now
+	g.pausedAt = time.Time{}
+
+	if g.log != nil {
+		// the log starts over from the restored state, since the game may have
+		// carried on for a while after it was last saved
+		restored, err := json.Marshal(checkpoint{
+			State:     g.GameState,
+			KillReady: g.killReady,
+			Tick:      g.tick,
+			Saved:     g.now,
+		})
+		if err != nil {
+			ErrorLogger.Println("Failed to log restored game, no longer logging it:", g.GameId, err)
+			g.log.close()
+			g.log = nil
+		} else {
+			g.record(&logEntry{Kind: LOG_RESTORE, Checkpoint: restored, Now: &Time{g.now}})
+			g.flushLog()
+		}
+	}
+
+	InfoLogger.Println("Resuming restored game:", g.GameId)
+
+	// start game loop
+	go g.watch()
+}
+
+// resumeIfReady resumes a restored game once none of its players is left to reconnect, assuming the lock is held
+func (s *server) resumeIfReady(g *game) {
+	for _, c := range s.staleClients {
+		if c.game == g {
+			return
+		}
+	}
+	g.resume()
+}
+
+// applyCheckpoint replaces the state of a blank game with a saved one
+func (g *game) applyCheckpoint(cp *checkpoint) {
+	g.GameState = cp.State
+	g.tick = cp.Tick
+	if cp.KillReady != nil {
+		g.killReady = cp.KillReady
+	}
+	if g.Bodies == nil {
+		g.Bodies = make(map[string]*Body)
+	}
+}
+
+// shiftTimes moves every deadline and timestamp of the game forward, before its loop is started
+func (g *game) shiftTimes(d time.Duration) {
+	for _, player := range g.Players {
+		player.LastHeard = Time{player.LastHeard.Add(d)}
+	}
+	for _, task := range g.Tasks {
+		if task.Start != nil {
+			task.Start = &Time{task.Start.Add(d)}
+		}
+	}
+	for _, body := range g.Bodies {
+		body.TimeOfDeath = Time{body.TimeOfDeath.Add(d)}
+	}
+	if g.Meeting != nil {
+		g.Meeting.Start = Time{g.Meeting.Start.Add(d)}
+		g.Meeting.PhaseEnd = Time{g.Meeting.PhaseEnd.Add(d)}
+	}
+	for playerId, ready := range g.killReady {
+		g.killReady[playerId] = ready.Add(d)
+	}
+}
+
+func (s *server) checkpointPath(gameId string) string {
+	return filepath.Join(s.config.CheckpointDir, gameId+".json")
+}
+
+// checkpointGames periodically saves every game in progress
+func (s *server) checkpointGames() {
+	ticker := time.NewTicker(s.config.CheckpointInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// gather the resume tokens of each game's players
+		s.mu.Lock()
+		games := make(map[*game]map[string]string, len(s.games.games))
+		for _, g := range s.games.games {
+			games[g] = make(map[string]string)
+		}
+		for _, clients := range []map[string]*client{s.clients, s.staleClients} {
+			for playerId, c := range clients {
+				if tokens, ok := games[c.game]; ok {
+					tokens[playerId] = c.resumeToken
+				}
+			}
+		}
+		s.mu.Unlock()
+
+		for g, tokens := range games {
+			s.saveCheckpoint(g, tokens)
+		}
+	}
+}
+
+// saveCheckpoint writes the checkpoint of a game in progress, without holding the lock during disk I/O
+func (s *server) saveCheckpoint(g *game, tokens map[string]string) {
+	// the game may have been retired in the meantime, and must not come back
+	if !s.registered(g) {
+		return
+	}
+
+	msg, err := g.checkpoint(tokens)
+	if err != nil {
+		ErrorLogger.Println("Failed to checkpoint game:", g.GameId, err)
+		return
+	}
+	if msg == nil {
+		return
+	}
+
+	if err := writeFileAtomic(s.checkpointPath(g.GameId), msg); err != nil {
+		ErrorLogger.Println("Failed to checkpoint game:", g.GameId, err)
+	}
+
+	// a game retired while its checkpoint was being written had nothing to delete yet
+	if !s.registered(g) {
+		s.forgetCheckpoint(g.GameId)
+	}
+}
+
+// registered checks whether a game is still running on the server
+func (s *server) registered(g *game) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.games.games[g.GameId]
+	return ok
+}
+
+// forgetCheckpoint deletes the checkpoint of a game that is over
+func (s *server) forgetCheckpoint(gameId string) {
+	if s.config.CheckpointInterval == 0 {
+		return
+	}
+
+	if err := os.Remove(s.checkpointPath(gameId)); err != nil && !os.IsNotExist(err) {
+		WarnLogger.Println("Failed to delete checkpoint:", gameId, err)
+	}
+}
+
+// restoreGames brings back the games saved before the server stopped, waiting for their players
+// to reconnect with the same id and resume token, before the server starts handling connections
+func (s *server) restoreGames() error {
+	if err := os.MkdirAll(s.config.CheckpointDir, 0700); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(s.config.CheckpointDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(s.config.CheckpointDir, file.Name())
+
+		msg, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var cp checkpoint
+		if err := json.Unmarshal(msg, &cp); err != nil {
+			WarnLogger.Println("Skipping invalid checkpoint:", path, err)
+			continue
+		}
+
+		if len(s.games.games) >= s.config.MaxGames {
+			WarnLogger.Println("Dropping checkpoint, server is full:", path, len(s.games.games), "games already running")
+			if err := os.Remove(path); err != nil {
+				WarnLogger.Println("Failed to delete checkpoint:", path, err)
+			}
+			continue
+		}
+
+		g, err := restoreGame(s.inbox, &cp, s.config.Timing, s.config.actionLogDir())
+		if err != nil {
+			WarnLogger.Println("Skipping checkpoint that cannot be restored:", path, err)
+			continue
+		}
+		s.games.games[g.GameId] = g
+
+		g.mu.Lock()
+		for playerId, player := range g.Players {
+			if !player.IsConnected {
+				continue
+			}
+			s.expireLater(&client{
+				player:      player,
+				game:        g,
+				resumeToken: cp.Tokens[playerId],
+			})
+		}
+		g.mu.Unlock()
+
+		// the game stays paused while its players reconnect, for as long as they are given to
+		s.resumeIfReady(g)
+		time.AfterFunc(RECONNECT_GRACE, g.resume)
+
+		InfoLogger.Println("Restored game:", g.GameId, "saved", cp.Saved)
+	}
+
+	return nil
+}
+
+// writeFileAtomic replaces a file at once, so readers never see half of it
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
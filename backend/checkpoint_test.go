@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestRetiredCheckpoint checks that a retired game leaves no checkpoint behind to be restored
+func TestRetiredCheckpoint(t *testing.T) {
+	config := testConfig()
+	config.CheckpointDir = t.TempDir()
+	config.CheckpointInterval = time.Hour
+	s, _ := testServer(t, config)
+
+	s.mu.Lock()
+	g, err := s.createGame()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < g.Settings.MaxPlayers; i++ {
+		if err := g.addPlayer(newPlayer("player")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g.start()
+
+	path := s.checkpointPath(g.GameId)
+	s.saveCheckpoint(g, nil)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("game in progress was not saved:", err)
+	}
+
+	s.mu.Lock()
+	s.retireGame(g)
+	s.mu.Unlock()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("retired game kept its checkpoint:", err)
+	}
+
+	s.saveCheckpoint(g, nil)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("retired game was saved again:", err)
+	}
+}
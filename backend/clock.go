@@ -0,0 +1,105 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	CLOCK_SYNC_INTERVAL = 1 * time.Second
+	CLOCK_SAMPLES       = 8
+	// oldest client timestamp accepted, once mapped to server time
+	MAX_TIMESTAMP_AGE = 1 * time.Second
+)
+
+// Ping is sent to clients, who answer right away with a Pong action
+type Ping struct {
+	Ping Time
+}
+
+// Pong echoes the server time of a ping along with the client time it was received at
+type Pong struct {
+	Ping Time
+	Time Time
+}
+
+type clockSample struct {
+	offset time.Duration
+	rtt    time.Duration
+}
+
+// clock estimates the offset of a client clock from the server clock, keeping the
+// sample with the lowest round trip among the latest ones like NTP's clock filter
+type clock struct {
+	samples [CLOCK_SAMPLES]clockSample
+	next    int
+	count   int
+	offset  time.Duration
+	rtt     time.Duration
+	// latest timestamp handed out, so mapped times never run backwards
+	last time.Time
+}
+
+// addSample records a ping sent at t1, received by the client at t2 and answered at t3
+func (c *clock) addSample(t1 time.Time, t2 time.Time, t3 time.Time) {
+	rtt := t3.Sub(t1)
+	if rtt < 0 {
+		return
+	}
+
+	c.samples[c.next] = clockSample{
+		offset: t2.Sub(t1.Add(rtt / 2)),
+		rtt:    rtt,
+	}
+	c.next = (c.next + 1) % CLOCK_SAMPLES
+	if c.count < CLOCK_SAMPLES {
+		c.count++
+	}
+
+	best := c.samples[0]
+	for _, sample := range c.samples[1:c.count] {
+		if sample.rtt < best.rtt {
+			best = sample
+		}
+	}
+	c.offset = best.offset
+	c.rtt = best.rtt
+}
+
+func (c *clock) synced() bool {
+	return c.count > 0
+}
+
+// toServer maps a client timestamp to server time, bounded by the time it was received
+// and by the previous timestamp, so that consecutive actions never go back in time
+func (c *clock) toServer(t time.Time, received time.Time) time.Time {
+	if !c.synced() {
+		t = received
+	} else {
+		t = t.Add(-c.offset)
+		if t.After(received) {
+			t = received
+		}
+		if received.Sub(t) > MAX_TIMESTAMP_AGE {
+			t = received.Add(-MAX_TIMESTAMP_AGE)
+		}
+	}
+
+	if t.Before(c.last) {
+		t = c.last
+	}
+	c.last = t
+	return t
+}
+
+// updateClock publishes the clock estimate of a player's connection
+func (g *game) updateClock(playerId string, offset time.Duration, rtt time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.record(&logEntry{Kind: LOG_CLOCK, PlayerId: playerId, Offset: offset, RoundTrip: rtt})
+
+	if p, ok := g.Players[playerId]; ok {
+		p.ClockOffset = float64(offset) / float64(time.Millisecond)
+		p.RoundTrip = float64(rtt) / float64(time.Millisecond)
+	}
+}
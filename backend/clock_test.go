@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTimestampsNeverGoBack checks that a client alternating between recent and old
+// timestamps cannot make time run backwards, and so cannot move without time passing
+func TestTimestampsNeverGoBack(t *testing.T) {
+	g := startedGame(t)
+	p := anyPlayer(g)
+	received := p.LastHeard.Time
+
+	var c clock
+	c.addSample(received.Add(-100*time.Millisecond), received.Add(-50*time.Millisecond), received)
+
+	step := 50.0
+	for i := 0; i < 20; i++ {
+		sent := received
+		if i%2 == 1 {
+			sent = received.Add(-MAX_TIMESTAMP_AGE)
+		}
+
+		timestamp := c.toServer(sent, received)
+		if timestamp.Before(p.LastHeard.Time) {
+			t.Fatalf("action %d went back in time by %v", i, p.LastHeard.Sub(timestamp))
+		}
+
+		step = -step
+		position := p.Position.add(Vector{X: step})
+		rejections := g.performAction(&Action{
+			PlayerId:  p.PlayerId,
+			Position:  &position,
+			Direction: &Vector{X: 1},
+			Timestamp: Time{timestamp},
+		})
+		if len(rejections) != 1 || rejections[0].Reason != REJECT_TOO_FAST {
+			t.Fatalf("move %d without time passing was not rejected as too fast: %v", i, rejections)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// serverConfig holds the tunables of the server, read from the environment
+type serverConfig struct {
+	// how long a client may leave messages unread before it is dropped
+	StarvationDeadline time.Duration
+
+	// how often clients are pinged, and how long they have to answer before they are considered dead
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	// how long a client may go without sending anything before it is dropped, or zero to keep idle clients
+	IdleTimeout time.Duration
+
+	// how often games step their simulation and send snapshots
+	Timing loopTiming
+
+	// how many games may run at once, and how long a game nobody is connected to is kept
+	MaxGames       int
+	AbandonTimeout time.Duration
+
+	// how the server advertises itself: to a UDP catalog, in a file, or not at all
+	Discovery        string
+	CatalogAddress   string
+	CatalogOwner     string
+	CatalogProject   string
+	DiscoveryFile    string
+	AnnounceInterval time.Duration
+
+	// where games in progress are saved, and how often, or zero to neither save nor restore them
+	CheckpointDir      string
+	CheckpointInterval time.Duration
+
+	// whether every game logs its actions to a file of its own in the directory, to be replayed later
+	ActionLog    bool
+	ActionLogDir string
+}
+
+var DEFAULT_SERVER_CONFIG = serverConfig{
+	StarvationDeadline: 5 * time.Second,
+	HeartbeatInterval:  5 * time.Second,
+	HeartbeatTimeout:   10 * time.Second,
+	IdleTimeout:        0,
+	Timing:             DEFAULT_TIMING,
+	MaxGames:           100,
+	AbandonTimeout:     1 * time.Minute,
+	Discovery:          DISCOVERY_CATALOG,
+	CatalogAddress:     "catalog.cse.nd.edu:9097",
+	CatalogOwner:       "gsilvasi,rdestefa",
+	CatalogProject:     "amongus",
+	DiscoveryFile:      "server.json",
+	AnnounceInterval:   60 * time.Second,
+	CheckpointDir:      "checkpoints",
+	CheckpointInterval: 5 * time.Second,
+	ActionLog:          false,
+	ActionLogDir:       "actionlogs",
+}
+
+// actionLogDir is where games log their actions, or empty if they do not
+func (c *serverConfig) actionLogDir() string {
+	if !c.ActionLog {
+		return ""
+	}
+	return c.ActionLogDir
+}
+
+// catalogConfig holds the tunables of the catalog mode, read from the environment
+type catalogConfig struct {
+	// where announcements are received, and where the list of servers is served
+	UDPAddress  string
+	HTTPAddress string
+
+	// how long a server is listed after its last announcement
+	Lifetime time.Duration
+}
+
+var DEFAULT_CATALOG_CONFIG = catalogConfig{
+	UDPAddress:  "0.0.0.0:9097",
+	HTTPAddress: "0.0.0.0:9097",
+	Lifetime:    5 * time.Minute,
+}
+
+// routerConfig holds the tunables of the router mode, read from the environment
+type routerConfig struct {
+	// where nodes announce themselves, and where players connect
+	UDPAddress  string
+	HTTPAddress string
+
+	// how long a node is considered healthy after its last announcement
+	Lifetime time.Duration
+
+	// send players to their node with a redirect instead of proxying their connection
+	Redirect bool
+}
+
+var DEFAULT_ROUTER_CONFIG = routerConfig{
+	UDPAddress:  "0.0.0.0:9098",
+	HTTPAddress: "0.0.0.0:10080",
+	Lifetime:    15 * time.Second,
+	Redirect:    false,
+}
+
+// loadServerConfig overrides the default configuration with environment variables
+func loadServerConfig() (serverConfig, error) {
+	config := DEFAULT_SERVER_CONFIG
+
+	if err := envDuration("STARVATION_DEADLINE", &config.StarvationDeadline); err != nil {
+		return config, err
+	}
+	if err := envDuration("HEARTBEAT_INTERVAL", &config.HeartbeatInterval); err != nil {
+		return config, err
+	}
+	if err := envDuration("HEARTBEAT_TIMEOUT", &config.HeartbeatTimeout); err != nil {
+		return config, err
+	}
+	if err := envDuration("IDLE_TIMEOUT", &config.IdleTimeout); err != nil {
+		return config, err
+	}
+
+	if err := envInt("TICK_RATE", &config.Timing.TickRate); err != nil {
+		return config, err
+	}
+	if err := envInt("SNAPSHOT_RATE", &config.Timing.SnapshotRate); err != nil {
+		return config, err
+	}
+
+	if err := envInt("MAX_GAMES", &config.MaxGames); err != nil {
+		return config, err
+	}
+	if err := envDuration("ABANDON_TIMEOUT", &config.AbandonTimeout); err != nil {
+		return config, err
+	}
+
+	envString("DISCOVERY", &config.Discovery)
+	envString("CATALOG_ADDRESS", &config.CatalogAddress)
+	envString("CATALOG_OWNER", &config.CatalogOwner)
+	envString("CATALOG_PROJECT", &config.CatalogProject)
+	envString("DISCOVERY_FILE", &config.DiscoveryFile)
+	if err := envDuration("ANNOUNCE_INTERVAL", &config.AnnounceInterval); err != nil {
+		return config, err
+	}
+
+	envString("CHECKPOINT_DIR", &config.CheckpointDir)
+	if err := envDuration("CHECKPOINT_INTERVAL", &config.CheckpointInterval); err != nil {
+		return config, err
+	}
+
+	if err := envBool("ACTION_LOG", &config.ActionLog); err != nil {
+		return config, err
+	}
+	envString("ACTION_LOG_DIR", &config.ActionLogDir)
+
+	if config.HeartbeatInterval <= 0 || config.HeartbeatTimeout <= 0 {
+		return config, fmt.Errorf("heartbeat interval and timeout must be positive")
+	}
+	if config.IdleTimeout < 0 {
+		return config, fmt.Errorf("idle timeout must not be negative: %v", config.IdleTimeout)
+	}
+	if config.MaxGames < 1 {
+		return config, fmt.Errorf("max games must be at least 1: %d", config.MaxGames)
+	}
+	if config.AnnounceInterval <= 0 {
+		return config, fmt.Errorf("announce interval must be positive: %v", config.AnnounceInterval)
+	}
+	if config.CheckpointInterval < 0 {
+		return config, fmt.Errorf("checkpoint interval must not be negative: %v", config.CheckpointInterval)
+	}
+	if err := config.Timing.validate(); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// loadCatalogConfig overrides the default catalog configuration with environment variables
+func loadCatalogConfig() (catalogConfig, error) {
+	config := DEFAULT_CATALOG_CONFIG
+
+	envString("CATALOG_UDP_ADDRESS", &config.UDPAddress)
+	envString("CATALOG_HTTP_ADDRESS", &config.HTTPAddress)
+	if err := envDuration("CATALOG_LIFETIME", &config.Lifetime); err != nil {
+		return config, err
+	}
+
+	if config.Lifetime <= 0 {
+		return config, fmt.Errorf("catalog lifetime must be positive: %v", config.Lifetime)
+	}
+
+	return config, nil
+}
+
+// loadRouterConfig overrides the default router configuration with environment variables
+func loadRouterConfig() (routerConfig, error) {
+	config := DEFAULT_ROUTER_CONFIG
+
+	envString("ROUTER_UDP_ADDRESS", &config.UDPAddress)
+	envString("ROUTER_HTTP_ADDRESS", &config.HTTPAddress)
+	if err := envDuration("ROUTER_LIFETIME", &config.Lifetime); err != nil {
+		return config, err
+	}
+	if err := envBool("ROUTER_REDIRECT", &config.Redirect); err != nil {
+		return config, err
+	}
+
+	if config.Lifetime <= 0 {
+		return config, fmt.Errorf("router lifetime must be positive: %v", config.Lifetime)
+	}
+
+	return config, nil
+}
+
+// envString reads an environment variable, if it is set
+func envString(name string, s *string) {
+	if value := os.Getenv(name); value != "" {
+		*s = value
+	}
+}
+
+// envDuration parses an environment variable such as "5s" into a duration, if it is set
+func envDuration(name string, d *time.Duration) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// envInt parses an environment variable into an integer, if it is set
+func envInt(name string, i *int) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*i = parsed
+	return nil
+}
+
+// envBool parses an environment variable such as "true" or "1" into a boolean, if it is set
+func envBool(name string, b *bool) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*b = parsed
+	return nil
+}
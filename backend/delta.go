@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+const (
+	// longest time between full snapshots sent to a player receiving deltas
+	KEYFRAME_PERIOD = 1 * time.Second
+	// frames kept per player to encode deltas against
+	DELTA_HISTORY = 32
+)
+
+// viewHistory keeps the frames recently sent to one player and the latest tick it acknowledged
+type viewHistory struct {
+	frames       [DELTA_HISTORY]*frame
+	ack          uint64
+	lastKeyframe uint64
+	// ticks between keyframes, at the game's snapshot rate
+	interval uint64
+}
+
+// base returns the acknowledged frame to encode a delta against, or nil when a keyframe is due
+func (h *viewHistory) base(tick uint64) *frame {
+	if h.ack == 0 || tick-h.lastKeyframe >= h.interval {
+		return nil
+	}
+
+	f := h.frames[h.ack%DELTA_HISTORY]
+	if f == nil || f.tick != h.ack {
+		return nil
+	}
+	return f
+}
+
+func (h *viewHistory) record(f *frame) {
+	h.frames[f.tick%DELTA_HISTORY] = f
+}
+
+// viewHistory returns the history of frames sent to a player, assuming the lock is held
+func (g *game) viewHistory(playerId string) *viewHistory {
+	h, ok := g.views[playerId]
+	if !ok {
+		h = &viewHistory{interval: g.timing.keyframeInterval()}
+		g.views[playerId] = h
+	}
+	return h
+}
+
+// acknowledge records the latest tick a player has applied
+func (g *game) acknowledge(playerId string, tick uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	h := g.viewHistory(playerId)
+	if tick > h.ack && tick <= g.tick {
+		h.ack = tick
+	}
+}
+
+// setBinary records whether a player's client uses the MessagePack protocol
+func (g *game) setBinary(playerId string, binary bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if binary {
+		g.binary[playerId] = true
+	} else {
+		delete(g.binary, playerId)
+	}
+}
+
+// isBinary tells whether messages to a player are encoded as MessagePack
+func (g *game) isBinary(playerId string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.binary[playerId]
+}
+
+// resetViews forgets what a player acknowledged, so its next snapshot is a keyframe
+func (g *game) resetViews(playerId string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.views, playerId)
+}
+
+// delta encodes only what changed in a player's view since a frame it acknowledged
+func (s *snapshot) delta(g *game, viewer *Player, base *frame, f *frame, now time.Time, binary bool) ([]byte, error) {
+	// pieces already marshalled for the snapshot are reused in the client's encoding
+	raw := func(piece func(*encoded) []byte) interface{} {
+		if binary {
+			return msgpackRaw(piece(s.packed))
+		}
+		return json.RawMessage(piece(&s.encoded))
+	}
+
+	msg := map[string]interface{}{
+		"Tick":      f.tick,
+		"BaseTick":  base.tick,
+		"Timestamp": raw(func(e *encoded) []byte { return e.timestamp }),
+	}
+
+	for _, field := range HEADER_FIELDS {
+		if !bytes.Equal(base.header[field], f.header[field]) {
+			field := field
+			msg[field] = raw(func(e *encoded) []byte { return e.header[field] })
+		}
+	}
+
+	players := make(map[string]interface{})
+	for playerId, player := range f.players {
+		old, ok := base.players[playerId]
+		if !ok {
+			players[playerId] = player
+		} else if changed := diffFields(old, player); changed != nil {
+			players[playerId] = changed
+		}
+	}
+	msg["Players"] = players
+
+	removed := make([]string, 0)
+	for playerId := range base.players {
+		if _, ok := f.players[playerId]; !ok {
+			removed = append(removed, playerId)
+		}
+	}
+	if len(removed) > 0 {
+		msg["RemovedPlayers"] = removed
+	}
+
+	tasks := make(map[string]interface{})
+	for taskId, task := range f.tasks {
+		if changed := diffFields(base.tasks[taskId], task); changed != nil {
+			tasks[taskId] = changed
+		}
+	}
+	msg["Tasks"] = tasks
+
+	if !bytes.Equal(base.bodies, f.bodies) {
+		if binary {
+			msg["Bodies"] = msgpackRaw(s.packedBodies(f))
+		} else {
+			msg["Bodies"] = json.RawMessage(f.bodies)
+		}
+	}
+
+	if viewer.IsImpostor && !g.inEndOfGame() {
+		msg["KillCooldown"] = g.killCooldown(viewer.PlayerId, now)
+	}
+
+	return encodeMessage(binary, msg)
+}
+
+// diffFields maps the names of the exported fields that differ between two structs of the same type to their new values
+func diffFields(old interface{}, new interface{}) map[string]interface{} {
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(new)
+
+	var changed map[string]interface{}
+	for i := 0; i < newValue.NumField(); i++ {
+		field := newValue.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		newField := newValue.Field(i).Interface()
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newField) {
+			if changed == nil {
+				changed = make(map[string]interface{})
+			}
+			changed[field.Name] = newField
+		}
+	}
+	return changed
+}
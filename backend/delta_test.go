@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// applyDelta patches a game state the way the README tells clients to
+func applyDelta(state map[string]interface{}, delta map[string]interface{}) {
+	for field, value := range delta {
+		switch field {
+		case "BaseTick":
+		case "Players", "Tasks":
+			entries := state[field].(map[string]interface{})
+			for id, changes := range value.(map[string]interface{}) {
+				entry, ok := entries[id].(map[string]interface{})
+				if !ok {
+					entries[id] = changes
+					continue
+				}
+				for name, changed := range changes.(map[string]interface{}) {
+					entry[name] = changed
+				}
+			}
+		case "RemovedPlayers":
+			for _, id := range value.([]interface{}) {
+				delete(state["Players"].(map[string]interface{}), id.(string))
+			}
+		default:
+			state[field] = value
+		}
+	}
+}
+
+// TestDeltas plays a game in which players move, die, leave bodies and start tasks, and checks
+// that every player patching the deltas they are sent keeps the state a full snapshot would show
+func TestDeltas(t *testing.T) {
+	g := startedGame(t)
+	toserver := make(chan *serverUpdate, 1)
+	g.toserver = toserver
+	// cooldowns run on the wall clock, which full snapshots would read later than deltas
+	g.killReady = make(map[string]time.Time)
+
+	playerIds := g.playerIds()
+	victims := make([]string, 0, 2)
+	for _, playerId := range playerIds {
+		if !g.Players[playerId].IsImpostor && len(victims) < 2 {
+			victims = append(victims, playerId)
+		}
+	}
+
+	states := make(map[string]map[string]interface{})
+	keyframes := make(map[string]uint64)
+	for step := uint64(1); step <= 3*g.timing.keyframeInterval(); step++ {
+		for _, p := range g.Players {
+			if p.IsAlive {
+				p.Position = p.Position.add(Vector{X: float64(step%2)*2 - 1})
+			}
+		}
+		switch step {
+		case 5, 8:
+			victim := g.Players[victims[step/8]]
+			victim.IsAlive = false
+			g.Bodies[victim.PlayerId] = &Body{PlayerId: victim.PlayerId, Position: victim.Position, TimeOfDeath: Time{g.now}}
+		case 12:
+			for _, task := range g.Tasks {
+				task.Completer = &playerIds[0]
+				task.Start = &Time{g.now}
+				break
+			}
+		case 18:
+			g.HostId = playerIds[1]
+		case 25:
+			g.Players[victims[0]].IsConnected = false
+		}
+
+		g.sendUpdate()
+		u := <-toserver
+
+		snap, err := g.newSnapshot(g.tick, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for playerId, msg := range u.gameStates {
+			p := g.Players[playerId]
+			want := unmarshal(t, snap.view(g, p, snap.frame(g, p), time.Now())).(map[string]interface{})
+
+			var received map[string]interface{}
+			if err := json.Unmarshal(msg, &received); err != nil {
+				t.Fatal(err)
+			}
+
+			if baseTick, ok := received["BaseTick"]; !ok {
+				keyframes[playerId] = g.tick
+				states[playerId] = received
+			} else {
+				state := states[playerId]
+				if baseTick != state["Tick"] {
+					t.Fatalf("tick %d: delta for %v against tick %v, but tick %v was applied", g.tick, playerId, baseTick, state["Tick"])
+				}
+				if _, ok := received["Bodies"]; ok && reflect.DeepEqual(state["Bodies"], want["Bodies"]) {
+					t.Fatalf("tick %d: delta for %v resends the bodies it already has", g.tick, playerId)
+				}
+				applyDelta(state, received)
+			}
+
+			if g.tick-keyframes[playerId] >= g.timing.keyframeInterval() {
+				t.Fatalf("tick %d: no keyframe for %v since tick %d", g.tick, playerId, keyframes[playerId])
+			}
+			if !reflect.DeepEqual(states[playerId], want) {
+				t.Fatalf("tick %d: state of %v after deltas\n%v\ndiffers from full snapshot\n%v", g.tick, playerId, states[playerId], want)
+			}
+
+			g.acknowledge(playerId, g.tick)
+		}
+	}
+}
+
+// TestKeyframePeriod checks that keyframes are due at least every KEYFRAME_PERIOD, whatever the snapshot rate
+func TestKeyframePeriod(t *testing.T) {
+	for _, rate := range []int{1, 5, 20, 60, 1000} {
+		timing := loopTiming{TickRate: 1000, SnapshotRate: rate}
+		interval := timing.keyframeInterval()
+		if interval < 1 || time.Duration(interval)*time.Second/time.Duration(rate) > KEYFRAME_PERIOD {
+			t.Fatalf("keyframes every %d snapshots at %d snapshots a second", interval, rate)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// VERSION is reported to the catalog, and may be set at build time with -ldflags "-X main.VERSION=..."
+var VERSION = "dev"
+
+// Names of the ways the server can advertise itself.
+const (
+	DISCOVERY_CATALOG = "catalog"
+	DISCOVERY_FILE    = "file"
+	DISCOVERY_NONE    = "none"
+)
+
+type CatalogAnnounce struct {
+	Type        string `json:"type"`
+	Owner       string `json:"owner"`
+	Port        int    `json:"port"`
+	Project     string `json:"project"`
+	Version     string `json:"version"`
+	Games       int    `json:"games"`
+	MaxGames    int    `json:"max_games"`
+	OpenLobbies int    `json:"open_lobbies"`
+	Players     int    `json:"players"`
+	// players waiting in the public lobby
+	Waiting int `json:"waiting"`
+	// set on the last announcement of a server that is shutting down
+	Deregister bool `json:"deregister,omitempty"`
+}
+
+// discovery advertises the server to clients looking for a game
+type discovery interface {
+	announce(a *CatalogAnnounce) error
+	deregister(a *CatalogAnnounce) error
+}
+
+// newDiscovery picks the discovery mechanism named in the configuration
+func newDiscovery(config serverConfig) (discovery, error) {
+	switch config.Discovery {
+	case DISCOVERY_CATALOG:
+		return &udpCatalog{address: config.CatalogAddress}, nil
+	case DISCOVERY_FILE:
+		return &staticFile{path: config.DiscoveryFile}, nil
+	case DISCOVERY_NONE:
+		return noDiscovery{}, nil
+	default:
+		return nil, fmt.Errorf("unknown discovery %q, expected %q, %q or %q",
+			config.Discovery, DISCOVERY_CATALOG, DISCOVERY_FILE, DISCOVERY_NONE)
+	}
+}
+
+// udpCatalog sends announcements as JSON datagrams to a catalog server
+type udpCatalog struct {
+	address string
+}
+
+func (c *udpCatalog) announce(a *CatalogAnnounce) error {
+	conn, err := net.DialTimeout("udp", c.address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(msg)
+	return err
+}
+
+// deregister asks the catalog to drop the server right away, though catalogs
+// that do not know about it simply let the entry expire
+func (c *udpCatalog) deregister(a *CatalogAnnounce) error {
+	a.Deregister = true
+	return c.announce(a)
+}
+
+// staticFile writes the announcement to a file, for another service to serve
+type staticFile struct {
+	path string
+}
+
+func (f *staticFile) announce(a *CatalogAnnounce) error {
+	msg, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(f.path, msg)
+}
+
+func (f *staticFile) deregister(a *CatalogAnnounce) error {
+	err := os.Remove(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// noDiscovery keeps the server unlisted, for clients that know where to find it
+type noDiscovery struct{}
+
+func (noDiscovery) announce(a *CatalogAnnounce) error {
+	return nil
+}
+
+func (noDiscovery) deregister(a *CatalogAnnounce) error {
+	return nil
+}
+
+// announcement describes the server as it currently is
+func (s *server) announcement(port int) *CatalogAnnounce {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := &CatalogAnnounce{
+		Type:     "game",
+		Owner:    s.config.CatalogOwner,
+		Port:     port,
+		Project:  s.config.CatalogProject,
+		Version:  VERSION,
+		Games:    len(s.games.games),
+		MaxGames: s.config.MaxGames,
+	}
+
+	if s.nextGame.inLobby() {
+		a.Waiting = s.nextGame.connectedPlayers()
+	}
+
+	for _, g := range s.games.games {
+		if g.inLobby() {
+			a.OpenLobbies++
+		}
+		a.Players += g.connectedPlayers()
+	}
+
+	return a
+}
+
+// announce advertises the server periodically until it shuts down, then deregisters it
+func (s *server) announce(port int) {
+	defer close(s.deregistered)
+
+	ticker := time.NewTicker(s.config.AnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.discovery.announce(s.announcement(port)); err != nil {
+			WarnLogger.Println("Failed to announce server:", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			if err := s.discovery.deregister(s.announcement(port)); err != nil {
+				WarnLogger.Println("Failed to deregister server:", err)
+			}
+			return
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"image"
 	"math"
 	"math/rand"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -27,40 +28,67 @@ const (
 	IN_PROGRESS
 	CREWMATES_WIN
 	IMPOSTORS_WIN
+	MEETING
+)
+
+// Enum type to describe the phase of a meeting.
+type MeetingPhase int
+
+const (
+	DISCUSSION = iota
+	VOTING
+	RESULTS
 )
 
 type GameState struct {
 	GameId    string
+	Code      string
+	HostId    string
 	Status    GameStatus
 	Players   map[string]*Player
 	Tasks     map[string]*Task
+	Bodies    map[string]*Body
+	Meeting   *Meeting
+	Settings  GameSettings
 	Timestamp *Time
 }
 
 type Player struct {
-	PlayerId    string
-	Name        string
-	Color       string
-	IsAlive     bool
-	IsImpostor  bool
-	IsConnected bool
-	Position    Vector
-	Direction   Vector
-	LastHeard   Time
-	DriftFactor int64
-	Drift       float64
+	PlayerId     string
+	Name         string
+	Color        string
+	IsAlive      bool
+	IsImpostor   bool
+	IsConnected  bool
+	Position     Vector
+	Direction    Vector
+	LastHeard    Time
+	ClockOffset  float64
+	RoundTrip    float64
+	MeetingsLeft int
+	LastInputSeq uint64
 }
 
 type Action struct {
 	PlayerId     string
 	Position     *Vector
 	Direction    *Vector
+	Input        *Vector
+	InputSeq     uint64
 	Kill         *string
 	StartTask    *string
 	CancelTask   *string
 	CompleteTask *string
+	StartGame    bool
+	Settings     *GameSettings
+	ReportBody   *string
+	CallMeeting  bool
+	Vote         *string
+	SkipVote     bool
+	Pong         *Pong
+	Ack          uint64
+	ActionId     uint64
 	Timestamp    Time
-	Drift        float64
 }
 
 type Task struct {
@@ -71,6 +99,23 @@ type Task struct {
 	IsComplete bool
 }
 
+type Body struct {
+	PlayerId    string
+	Position    Vector
+	TimeOfDeath Time
+}
+
+// Votes maps each voter to the player they voted for, or nil if they skipped.
+type Meeting struct {
+	CalledBy string
+	Reported *string
+	Phase    MeetingPhase
+	Votes    map[string]*string
+	Ejected  *string
+	Start    Time
+	PhaseEnd Time
+}
+
 type Time struct {
 	time.Time
 }
@@ -78,14 +123,36 @@ type Time struct {
 type game struct {
 	GameState
 
-	sentLast bool
-	inbox    chan *gameUpdate
-	toserver chan *serverUpdate
-	mu       sync.RWMutex
+	sentLast  bool
+	killReady map[string]time.Time
+	history   map[string]*positionHistory
+	views     map[string]*viewHistory
+	binary    map[string]bool
+	replies   map[string][][]byte
+	tick      uint64
+	simTick   uint64
+	timing    loopTiming
+	inputs    *inputQueues
+	inbox     chan *gameUpdate
+	toserver  chan *serverUpdate
+	mu        sync.RWMutex
+
+	// clock of the rules, set once per step so that a replay sees the same times
+	now time.Time
+	log *actionLog
+	// whether the current step is yet to be logged
+	tickPending bool
+	// when a restored game was paused, until its players are back
+	pausedAt time.Time
+	// seed of the roles drawn at the start, until it is logged
+	startSeed *int64
+	// seed to draw the roles with, when replaying a log
+	replaySeed *int64
 }
 
 type gameUpdate struct {
 	action     *Action
+	clock      *clock
 	disconnect *string
 	quit       bool
 }
@@ -110,10 +177,7 @@ var (
 
 const (
 	START_RADIUS   = 70.0
-	MOVE_SPEED     = 120.0
 	MOVE_ALLOWANCE = 1
-	KILL_RANGE     = 30.0
-	TASK_RANGE     = 60.0
 )
 
 func init() {
@@ -132,29 +196,67 @@ func checkNavmesh(v *Vector) bool {
 	return alpha != 0
 }
 
-func newGame(toserver chan *serverUpdate) *game {
-	g := &game{
+// newGame creates a lobby and starts its loop, logging its actions to logDir unless it is empty
+func newGame(toserver chan *serverUpdate, settings GameSettings, timing loopTiming, logDir string) (*game, error) {
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+
+	g := blankGame(toserver, settings, timing)
+	g.now = serverNow()
+	g.addTasks()
+
+	if logDir != "" {
+		log, err := openActionLog(logDir, g.GameId)
+		if err != nil {
+			return nil, err
+		}
+		g.log = log
+		g.record(&logEntry{Kind: LOG_CREATE, GameId: g.GameId, Settings: &g.Settings, Now: &Time{g.now}})
+		g.flushLog()
+	}
+
+	// start game loop
+	go g.watch()
+
+	return g, nil
+}
+
+// blankGame allocates a game without tasks, leaving it to the caller to start its loop
+func blankGame(toserver chan *serverUpdate, settings GameSettings, timing loopTiming) *game {
+	return &game{
 		GameState: GameState{
-			GameId:  uuid.NewString(),
-			Status:  LOBBY,
-			Players: make(map[string]*Player),
-			Tasks:   make(map[string]*Task),
+			GameId:   uuid.NewString(),
+			Status:   LOBBY,
+			Players:  make(map[string]*Player),
+			Tasks:    make(map[string]*Task),
+			Bodies:   make(map[string]*Body),
+			Settings: settings,
 		},
 
-		sentLast: false,
-		inbox:    make(chan *gameUpdate, 16),
-		toserver: toserver,
+		sentLast:  false,
+		killReady: make(map[string]time.Time),
+		history:   make(map[string]*positionHistory),
+		views:     make(map[string]*viewHistory),
+		binary:    make(map[string]bool),
+		timing:    timing,
+		inputs:    newInputQueues(),
+		inbox:     make(chan *gameUpdate, 16),
+		toserver:  toserver,
 	}
+}
 
+// addTasks lays out every task, not started yet
+func (g *game) addTasks() {
 	for _, task := range TASKS {
 		taskCopy := task
 		g.Tasks[task.TaskId] = &taskCopy
 	}
+}
 
-	// start game loop
-	go g.watch()
-
-	return g
+// serverNow reads the clock at the precision times are logged and sent with
+func serverNow() time.Time {
+	return time.Now().Truncate(time.Microsecond)
 }
 
 func newPlayer(name string) *Player {
@@ -167,46 +269,118 @@ func newPlayer(name string) *Player {
 		IsConnected: true,
 		Position:    START_CENTER,
 		Direction:   START_CENTER,
-		LastHeard:   Time{time.Now()},
+		LastHeard:   Time{serverNow()},
 	}
 
 	return p
 }
 
 func (g *game) readyToStart() bool {
-	return len(g.Players) == 10
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.Status == LOBBY && len(g.Players) == g.Settings.MaxPlayers
+}
+
+// inLobby checks whether the game is still waiting for players
+func (g *game) inLobby() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.Status == LOBBY
+}
+
+// finished checks whether the game has been won
+func (g *game) finished() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.inEndOfGame()
+}
+
+// connectedPlayers counts the players still attached to the game, including those who may reconnect
+func (g *game) connectedPlayers() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	n := 0
+	for _, player := range g.Players {
+		if player.IsConnected {
+			n++
+		}
+	}
+	return n
 }
 
 func (g *game) addPlayer(p *Player) error {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
-	if g.Status != LOBBY || len(g.Players) >= 10 {
+	if g.Status != LOBBY || len(g.Players) >= g.Settings.MaxPlayers {
 		return errors.New("unable to add player to game")
 	}
 
 	g.Players[p.PlayerId] = p
 
+	// the first player to join hosts the lobby
+	if g.HostId == "" {
+		g.HostId = p.PlayerId
+	}
+
+	joined := *p
+	g.record(&logEntry{Kind: LOG_JOIN, Player: &joined})
+
 	return nil
 }
 
+// setCode makes the game a private lobby, joined with the given code
+func (g *game) setCode(code string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.Code = code
+	g.record(&logEntry{Kind: LOG_CODE, Code: code})
+}
+
+// watch runs the simulation in fixed steps, sending a snapshot every few steps,
+// and handles the updates the server sends in between
 func (g *game) watch() {
-	ticker := time.NewTicker(50 * time.Millisecond) // 20/s
+	step := g.timing.step()
+	ticker := time.NewTicker(step)
 	defer ticker.Stop()
 
+	overruns := newOverrunMonitor(g.GameId, step)
+	next := time.Now().Add(step)
+
 	for {
 		select {
-		case <-ticker.C:
-			g.sendUpdate()
+		case now := <-ticker.C:
+			// run every step that is due, in case the ticker dropped some while the loop was busy
+			for steps := 0; !next.After(now); steps++ {
+				if steps == MAX_CATCHUP_STEPS {
+					behind := uint64(now.Sub(next)/step) + 1
+					overruns.skip(behind)
+					next = next.Add(time.Duration(behind) * step)
+					break
+				}
+
+				start := time.Now()
+				g.simulate(step)
+				if g.simTick%g.timing.stepsPerSnapshot() == 0 {
+					g.sendUpdate()
+				}
+				overruns.record(time.Since(start))
+
+				next = next.Add(step)
+			}
 		case u := <-g.inbox:
 			if u.quit {
 				ticker.Stop()
 				close(g.inbox)
+				g.closeLog()
 				return
-			} else if u.action != nil {
-				g.performAction(u.action)
-				g.checkEndOfGame()
 			} else if u.disconnect != nil {
+				g.inputs.remove(*u.disconnect)
 				g.disconnectPlayer(*u.disconnect)
 				g.checkEndOfGame()
 			}
@@ -214,72 +388,178 @@ func (g *game) watch() {
 	}
 }
 
-func (g *game) sendUpdate() {
+// simulate advances the game by one step of fixed duration
+func (g *game) simulate(dt time.Duration) {
 	g.mu.Lock()
+	g.simTick++
+	g.now = serverNow()
+	// steps of a lobby or of a finished game change nothing by themselves,
+	// so they are only logged once something happens during them
+	g.tickPending = g.log != nil
+	if g.tickPending && (g.Status == IN_PROGRESS || g.Status == MEETING) {
+		g.logTick()
+	}
+	g.mu.Unlock()
 
-	endgame := g.inEndOfGame()
+	for _, u := range g.inputs.drain() {
+		g.handleAction(u)
+	}
+	g.advance(dt)
 
-	// get a list of connected player ids in this game
-	playerIds := make([]string, 0, len(g.Players))
-	for playerId, player := range g.Players {
-		if player.IsConnected {
-			playerIds = append(playerIds, playerId)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.log != nil && !g.tickPending {
+		hash, err := g.stateHash()
+		if err != nil {
+			ErrorLogger.Println("Failed to hash game state:", g.GameId, err)
 		}
+		g.record(&logEntry{Kind: LOG_STEP, Dt: dt, Hash: hash})
+	}
+	g.tickPending = false
+	g.flushLog()
+}
+
+// advance runs the rules that depend on time passing rather than on actions
+func (g *game) advance(dt time.Duration) {
+	g.integrateMovement(dt)
+	g.updateMeeting()
+	g.checkEndOfGame()
+}
+
+// handleAction applies an action taken from a player's input queue
+func (g *game) handleAction(u *gameUpdate) {
+	// the log keeps times to the microsecond, so the rules must not see more
+	u.action.Timestamp = Time{u.action.Timestamp.Truncate(time.Microsecond)}
+
+	if u.clock != nil {
+		g.updateClock(u.action.PlayerId, u.clock.offset, u.clock.rtt)
+	}
+	if u.action.Ack > 0 {
+		g.acknowledge(u.action.PlayerId, u.action.Ack)
+	}
+	rejections := g.performAction(u.action)
+	g.reply(u.action, rejections)
+	g.checkEndOfGame()
+}
+
+func (g *game) sendUpdate() {
+	g.mu.Lock()
+
+	endgame := g.inEndOfGame()
+	if endgame && g.sentLast {
+		DebugLogger.Println("Skipping post-game update, already sent", g.GameId)
+		g.replies = nil
+		g.mu.Unlock()
+		return
 	}
 
-	// marshall game state to free game lock
-	g.GameState.Timestamp = &Time{time.Now()} // T3
-	marshalledGameState, err := json.Marshal(g.GameState)
+	now := time.Now()
+	g.GameState.Timestamp = &Time{now} // T3
+	g.tick++
+
+	// marshall shared parts of the game state once
+	snap, err := g.newSnapshot(g.tick, len(g.binary) > 0)
 	if err != nil {
-		ErrorLogger.Println("sendUpdate failed to marshall game state")
+		ErrorLogger.Println("sendUpdate failed to marshall game state:", err)
+		g.mu.Unlock()
 		return
 	}
 
-	// send snapshot of game state to those players
+	// build the view of the game state of each connected player, as a delta
+	// against the last frame they acknowledged when possible
+	gameStates := make(map[string][]byte, len(g.Players))
+	for playerId, player := range g.Players {
+		if !player.IsConnected {
+			continue
+		}
+
+		f := snap.frame(g, player)
+		h := g.viewHistory(playerId)
+		binary := g.binary[playerId]
+		if base := h.base(g.tick); base != nil && !endgame {
+			if gameStates[playerId], err = snap.delta(g, player, base, f, now, binary); err != nil {
+				ErrorLogger.Println("sendUpdate failed to encode delta:", playerId, err)
+			}
+		}
+		if gameStates[playerId] == nil {
+			if binary {
+				gameStates[playerId] = snap.packedView(g, player, f, now)
+			} else {
+				gameStates[playerId] = snap.view(g, player, f, now)
+			}
+			h.lastKeyframe = g.tick
+		}
+		h.record(f)
+	}
+
+	// send snapshots of game state to those players
 	u := &serverUpdate{
-		gameState: marshalledGameState,
-		playerIds: playerIds,
+		gameStates: gameStates,
+		replies:    g.replies,
 	}
+	g.replies = nil
 
 	if endgame {
-		if !g.sentLast {
-			g.sentLast = true
-			u.endgame = g
-		} else {
-			DebugLogger.Println("Skipping post-game update, already sent", u)
-			g.mu.Unlock()
-			return
-		}
+		g.sentLast = true
+		u.endgame = g
 	}
 
 	g.mu.Unlock()
 
-	DebugLogger.Println("Send update", u)
+	DebugLogger.Println("Send update", g.GameId)
 
 	g.toserver <- u
 }
 
-func (g *game) performAction(a *Action) {
+// killCooldown returns the seconds left before an impostor may kill again
+func (g *game) killCooldown(playerId string, now time.Time) float64 {
+	if ready, ok := g.killReady[playerId]; ok && ready.After(now) {
+		return ready.Sub(now).Seconds()
+	}
+	return 0
+}
+
+// resetKillCooldowns restarts the cooldown of every impostor, assuming the lock is held
+func (g *game) resetKillCooldowns() {
+	ready := g.now.Add(g.Settings.KillCooldown.Duration)
+	for playerId, player := range g.Players {
+		if player.IsImpostor {
+			g.killReady[playerId] = ready
+		}
+	}
+}
+
+func (g *game) performAction(a *Action) []Rejection {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
+	rejections := make([]Rejection, 0)
+	reject := func(action string, reason RejectReason) {
+		rejections = append(rejections, Rejection{Action: action, Reason: reason})
+	}
+
+	// rejected actions are logged too, so a replay can check it rejects them alike
+	defer func() {
+		performed := *a
+		g.record(&logEntry{Kind: LOG_ACTION, Action: &performed, Rejections: rejections})
+	}()
+
 	DebugLogger.Println("Perform action:", a)
 
 	p, ok := g.Players[a.PlayerId]
 	if !ok {
 		WarnLogger.Println("could not find player:", a.PlayerId)
-		return
+		reject("Action", REJECT_UNKNOWN_PLAYER)
+		return rejections
 	}
 
 	if !p.IsAlive {
 		WarnLogger.Println("attempt to perform action while not alive:", a.PlayerId)
-		return
+		reject("Action", REJECT_NOT_ALIVE)
+		return rejections
 	}
 
-	// update drift
-	p.DriftFactor = time.Since(a.Timestamp.Time).Milliseconds()
-	p.Drift = a.Drift
-
 	// update position and direction
 	if a.Position != nil {
 		DebugLogger.Println("Action position: a.Position", a.Position)
@@ -287,34 +567,78 @@ func (g *game) performAction(a *Action) {
 
 		if g.Status != IN_PROGRESS {
 			WarnLogger.Println("attempt to move when not in progress:", a.PlayerId)
+			reject("Position", REJECT_NOT_IN_PROGRESS)
 			goto PositionNoOp
 		}
 
-		duration := a.Timestamp.Sub(p.LastHeard.Time).Seconds()
-		maxDistanceSquared := math.Pow(duration*MOVE_SPEED+MOVE_ALLOWANCE, 2)
+		if g.Settings.AuthoritativeMovement {
+			WarnLogger.Println("attempt to set position when movement is server-authoritative:", a.PlayerId)
+			reject("Position", REJECT_WRONG_MOVEMENT_MODE)
+			goto PositionNoOp
+		}
+
+		if a.Direction == nil {
+			WarnLogger.Println("move without a direction from player:", a.PlayerId)
+			reject("Position", REJECT_INVALID_ACTION)
+			goto PositionNoOp
+		}
+
+		// timestamps from an earlier connection may be ahead, which allows no extra distance
+		duration := math.Max(a.Timestamp.Sub(p.LastHeard.Time).Seconds(), 0)
+		maxDistanceSquared := math.Pow(duration*g.Settings.MoveSpeed+MOVE_ALLOWANCE, 2)
 		distanceSquared := a.Position.squaredDistance(p.Position)
 		if distanceSquared > maxDistanceSquared {
 			distance := math.Sqrt(distanceSquared)
 			speed := distance / duration
 			WarnLogger.Println("excessive movement from player:", a.PlayerId, speed)
+			reject("Position", REJECT_TOO_FAST)
 			goto PositionNoOp
 		}
 
 		if !checkNavmesh(a.Position) {
 			WarnLogger.Println("out of bounds move from player:", a.PlayerId)
+			reject("Position", REJECT_OUT_OF_BOUNDS)
 			goto PositionNoOp
 		}
 
 		p.Position = *a.Position
 		p.Direction = *a.Direction
+		g.recordPosition(p, g.now)
 	}
 PositionNoOp:
 
+	// update input direction, integrated by the game loop every tick
+	if a.Input != nil {
+		if !g.Settings.AuthoritativeMovement {
+			WarnLogger.Println("attempt to send input when movement is client-authoritative:", a.PlayerId)
+			reject("Input", REJECT_WRONG_MOVEMENT_MODE)
+			goto InputNoOp
+		}
+
+		if a.InputSeq <= p.LastInputSeq {
+			DebugLogger.Println("Skipping out of order input:", a.PlayerId, a.InputSeq, p.LastInputSeq)
+			reject("Input", REJECT_OUT_OF_ORDER)
+			goto InputNoOp
+		}
+
+		p.LastInputSeq = a.InputSeq
+
+		if g.Status != IN_PROGRESS {
+			WarnLogger.Println("attempt to move when not in progress:", a.PlayerId)
+			reject("Input", REJECT_NOT_IN_PROGRESS)
+			goto InputNoOp
+		}
+
+		p.Direction = normalizeInput(*a.Input)
+	}
+InputNoOp:
+
 	p.LastHeard = a.Timestamp
 
 	if a.Kill != nil {
 		if g.Status != IN_PROGRESS {
 			WarnLogger.Println("attempt to kill when not in progress:", a.PlayerId)
+			reject("Kill", REJECT_NOT_IN_PROGRESS)
 			goto KillNoOp
 		}
 
@@ -322,29 +646,54 @@ PositionNoOp:
 
 		if !pKiller.IsImpostor {
 			ErrorLogger.Println("attempt to kill while not an impostor:", a.PlayerId)
+			reject("Kill", REJECT_NOT_IMPOSTOR)
 			goto KillNoOp
 		}
 
 		pVictim, ok := g.Players[*a.Kill]
 		if !ok {
 			ErrorLogger.Println("could not find player to kill:", *a.Kill)
+			reject("Kill", REJECT_UNKNOWN_PLAYER)
 			goto KillNoOp
 		}
 
 		if pVictim.IsImpostor {
 			ErrorLogger.Println("attempt to kill another impostor:", a.PlayerId)
+			reject("Kill", REJECT_TARGET_IMPOSTOR)
 			goto KillNoOp
 		}
 
-		duration := a.Timestamp.Sub(pVictim.LastHeard.Time).Seconds()
-		maxDistanceSquared := math.Pow(duration*MOVE_SPEED+KILL_RANGE+MOVE_ALLOWANCE, 2)
-		distanceSquared := pKiller.Position.squaredDistance(pVictim.Position)
+		if !pVictim.IsAlive {
+			WarnLogger.Println("attempt to kill dead player:", a.PlayerId, *a.Kill)
+			reject("Kill", REJECT_TARGET_DEAD)
+			goto KillNoOp
+		}
+
+		// the cooldown is tracked with the server clock so clients cannot skew it
+		if ready := g.killReady[pKiller.PlayerId]; g.now.Before(ready) {
+			ErrorLogger.Println("rule violation: kill before cooldown expired:", a.PlayerId, ready.Sub(g.now))
+			reject("Kill", REJECT_COOLDOWN)
+			goto KillNoOp
+		}
+
+		// rewind the victim to where the killer saw them when sending the kill
+		victimPosition := g.rewindPosition(pVictim, a.Timestamp.Time)
+		maxDistanceSquared := math.Pow(g.Settings.KillRange+MOVE_ALLOWANCE, 2)
+		distanceSquared := pKiller.Position.squaredDistance(victimPosition)
 		if distanceSquared > maxDistanceSquared {
 			WarnLogger.Println("invalid kill distance from player:", a.PlayerId)
+			reject("Kill", REJECT_TOO_FAR)
 			goto KillNoOp
 		}
 
 		pVictim.IsAlive = false
+		g.killReady[pKiller.PlayerId] = g.now.Add(g.Settings.KillCooldown.Duration)
+
+		g.Bodies[pVictim.PlayerId] = &Body{
+			PlayerId:    pVictim.PlayerId,
+			Position:    pVictim.Position,
+			TimeOfDeath: Time{g.now},
+		}
 
 		for _, task := range g.Tasks {
 			if !task.IsComplete && task.Completer != nil && *task.Completer == pVictim.PlayerId {
@@ -358,27 +707,32 @@ KillNoOp:
 	if a.StartTask != nil {
 		if g.Status != IN_PROGRESS {
 			WarnLogger.Println("attempt to start task when not in progress:", a.PlayerId)
+			reject("StartTask", REJECT_NOT_IN_PROGRESS)
 			goto TaskStartNoOp
 		}
 
 		task, ok := g.Tasks[*a.StartTask]
 		if !ok {
 			WarnLogger.Println("invalid task id to be started:", a.StartTask)
+			reject("StartTask", REJECT_UNKNOWN_TASK)
 			goto TaskStartNoOp
 		}
 
-		if p.Position.squaredDistance(task.Location) > math.Pow(TASK_RANGE, 2)+EPS {
+		if p.Position.squaredDistance(task.Location) > math.Pow(g.Settings.TaskRange, 2)+EPS {
 			WarnLogger.Println("task to be started is too far:", a.StartTask)
+			reject("StartTask", REJECT_TOO_FAR)
 			goto TaskStartNoOp
 		}
 
 		if task.IsComplete {
 			WarnLogger.Println("attempt to start task that is already completed:", a.StartTask)
+			reject("StartTask", REJECT_TASK_COMPLETED)
 			goto TaskStartNoOp
 		}
 
 		if task.Completer != nil {
 			WarnLogger.Println("attempt to start task that is already started:", a.StartTask, p.PlayerId)
+			reject("StartTask", REJECT_TASK_STARTED)
 			goto TaskStartNoOp
 		}
 
@@ -390,32 +744,38 @@ TaskStartNoOp:
 	if a.CancelTask != nil {
 		if g.Status != IN_PROGRESS {
 			WarnLogger.Println("attempt to start task when not in progress:", a.PlayerId)
+			reject("CancelTask", REJECT_NOT_IN_PROGRESS)
 			goto TaskCancelNoOp
 		}
 
 		task, ok := g.Tasks[*a.CancelTask]
 		if !ok {
 			WarnLogger.Println("invalid task id to be cancelled:", a.CancelTask)
+			reject("CancelTask", REJECT_UNKNOWN_TASK)
 			goto TaskCancelNoOp
 		}
 
-		if p.Position.squaredDistance(task.Location) > math.Pow(TASK_RANGE, 2)+EPS {
+		if p.Position.squaredDistance(task.Location) > math.Pow(g.Settings.TaskRange, 2)+EPS {
 			WarnLogger.Println("task to be cancelled is too far:", a.CancelTask)
+			reject("CancelTask", REJECT_TOO_FAR)
 			goto TaskCancelNoOp
 		}
 
 		if task.IsComplete {
 			WarnLogger.Println("attempt to cancel task that is already completed:", a.CancelTask)
+			reject("CancelTask", REJECT_TASK_COMPLETED)
 			goto TaskCancelNoOp
 		}
 
 		if task.Completer == nil {
 			WarnLogger.Println("attempt to cancel task that is not started:", a.CancelTask, p.PlayerId)
+			reject("CancelTask", REJECT_TASK_NOT_STARTED)
 			goto TaskCancelNoOp
 		}
 
 		if *task.Completer != p.PlayerId {
 			WarnLogger.Println("attempt to cancel task that is being completed by someone else:", a.CancelTask, *task.Completer, p.PlayerId)
+			reject("CancelTask", REJECT_TASK_TAKEN)
 			goto TaskCancelNoOp
 		}
 
@@ -427,52 +787,310 @@ TaskCancelNoOp:
 	if a.CompleteTask != nil {
 		if g.Status != IN_PROGRESS {
 			WarnLogger.Println("attempt to complete task when not in progress:", a.PlayerId)
+			reject("CompleteTask", REJECT_NOT_IN_PROGRESS)
 			goto TaskCompleteNoOp
 		}
 
 		task, ok := g.Tasks[*a.CompleteTask]
 		if !ok {
 			WarnLogger.Println("invalid task id to be completed:", a.CompleteTask)
+			reject("CompleteTask", REJECT_UNKNOWN_TASK)
 			goto TaskCompleteNoOp
 		}
 
-		if p.Position.squaredDistance(task.Location) > math.Pow(TASK_RANGE, 2)+EPS {
+		if p.Position.squaredDistance(task.Location) > math.Pow(g.Settings.TaskRange, 2)+EPS {
 			WarnLogger.Println("task to be completed is too far:", a.CompleteTask)
+			reject("CompleteTask", REJECT_TOO_FAR)
 			goto TaskCompleteNoOp
 		}
 
 		if task.IsComplete {
 			WarnLogger.Println("attempt to complete task that is already completed:", a.CompleteTask)
+			reject("CompleteTask", REJECT_TASK_COMPLETED)
 			goto TaskCompleteNoOp
 		}
 
 		if task.Completer == nil {
 			WarnLogger.Println("attempt to complete task that wasn't started:", a.CompleteTask, p.PlayerId)
+			reject("CompleteTask", REJECT_TASK_NOT_STARTED)
 			goto TaskCompleteNoOp
 		}
 
 		if *task.Completer != p.PlayerId {
 			WarnLogger.Println("attempt to complete task that is being completed by someone else:", a.CompleteTask, *task.Completer, p.PlayerId)
+			reject("CompleteTask", REJECT_TASK_TAKEN)
 			goto TaskCompleteNoOp
 		}
 
-		if a.Timestamp.Sub(task.Start.Time) < 5*time.Second {
-			WarnLogger.Println("attempt to complete task earlier than 5 seconds since start:", a.CompleteTask, p.PlayerId)
+		if a.Timestamp.Sub(task.Start.Time) < g.Settings.TaskDuration.Duration {
+			WarnLogger.Println("attempt to complete task earlier than task duration since start:", a.CompleteTask, p.PlayerId)
+			reject("CompleteTask", REJECT_TOO_EARLY)
 			goto TaskCompleteNoOp
 		}
 
 		g.Tasks[*a.CompleteTask].IsComplete = true
 	}
 TaskCompleteNoOp:
+
+	if a.Settings != nil {
+		if g.Status != LOBBY {
+			WarnLogger.Println("attempt to change settings after lobby:", a.PlayerId)
+			reject("Settings", REJECT_NOT_IN_LOBBY)
+			goto SettingsNoOp
+		}
+
+		// whoever joined the public lobby first must not change the rules for everyone else
+		if g.Code == "" {
+			WarnLogger.Println("attempt to change settings of the public lobby:", a.PlayerId)
+			reject("Settings", REJECT_PUBLIC_LOBBY)
+			goto SettingsNoOp
+		}
+
+		if g.HostId != p.PlayerId {
+			WarnLogger.Println("attempt to change settings while not host:", a.PlayerId)
+			reject("Settings", REJECT_NOT_HOST)
+			goto SettingsNoOp
+		}
+
+		if err := a.Settings.validate(); err != nil {
+			WarnLogger.Println("invalid settings from host:", a.PlayerId, err)
+			reject("Settings", REJECT_INVALID_SETTINGS)
+			goto SettingsNoOp
+		}
+
+		if len(g.Players) > a.Settings.MaxPlayers {
+			WarnLogger.Println("settings allow fewer players than in lobby:", a.PlayerId)
+			reject("Settings", REJECT_INVALID_SETTINGS)
+			goto SettingsNoOp
+		}
+
+		g.Settings = *a.Settings
+	}
+SettingsNoOp:
+
+	if a.StartGame {
+		if g.Status != LOBBY {
+			WarnLogger.Println("attempt to start game after lobby:", a.PlayerId)
+			reject("StartGame", REJECT_NOT_IN_LOBBY)
+			goto StartGameNoOp
+		}
+
+		if g.HostId != p.PlayerId {
+			WarnLogger.Println("attempt to start game while not host:", a.PlayerId)
+			reject("StartGame", REJECT_NOT_HOST)
+			goto StartGameNoOp
+		}
+
+		if len(g.Players) < g.Settings.MinPlayers {
+			WarnLogger.Println("attempt to start game with too few players:", a.PlayerId, len(g.Players))
+			reject("StartGame", REJECT_TOO_FEW_PLAYERS)
+			goto StartGameNoOp
+		}
+
+		InfoLogger.Println("Host started game:", g.GameId, a.PlayerId)
+		g.startLocked()
+	}
+StartGameNoOp:
+
+	if a.CallMeeting {
+		if g.Status != IN_PROGRESS {
+			WarnLogger.Println("attempt to call meeting when not in progress:", a.PlayerId)
+			reject("CallMeeting", REJECT_NOT_IN_PROGRESS)
+			goto CallMeetingNoOp
+		}
+
+		if p.MeetingsLeft <= 0 {
+			WarnLogger.Println("attempt to call meeting with none left:", a.PlayerId)
+			reject("CallMeeting", REJECT_NO_MEETINGS_LEFT)
+			goto CallMeetingNoOp
+		}
+
+		p.MeetingsLeft--
+		g.startMeeting(p.PlayerId, nil)
+	}
+CallMeetingNoOp:
+
+	if a.ReportBody != nil {
+		if g.Status != IN_PROGRESS {
+			WarnLogger.Println("attempt to report body when not in progress:", a.PlayerId)
+			reject("ReportBody", REJECT_NOT_IN_PROGRESS)
+			goto ReportBodyNoOp
+		}
+
+		body, ok := g.Bodies[*a.ReportBody]
+		if !ok {
+			WarnLogger.Println("could not find body to report:", *a.ReportBody)
+			reject("ReportBody", REJECT_UNKNOWN_BODY)
+			goto ReportBodyNoOp
+		}
+
+		if p.Position.squaredDistance(body.Position) > math.Pow(g.Settings.ReportRange, 2)+EPS {
+			WarnLogger.Println("body to be reported is too far:", a.PlayerId, *a.ReportBody)
+			reject("ReportBody", REJECT_TOO_FAR)
+			goto ReportBodyNoOp
+		}
+
+		g.startMeeting(p.PlayerId, &body.PlayerId)
+	}
+ReportBodyNoOp:
+
+	if a.Vote != nil || a.SkipVote {
+		if g.Status != MEETING || g.Meeting.Phase != VOTING {
+			WarnLogger.Println("attempt to vote outside of voting phase:", a.PlayerId)
+			reject("Vote", REJECT_NOT_VOTING)
+			goto VoteNoOp
+		}
+
+		if _, ok := g.Meeting.Votes[p.PlayerId]; ok {
+			WarnLogger.Println("attempt to vote more than once:", a.PlayerId)
+			reject("Vote", REJECT_ALREADY_VOTED)
+			goto VoteNoOp
+		}
+
+		if a.SkipVote {
+			g.Meeting.Votes[p.PlayerId] = nil
+			goto VoteNoOp
+		}
+
+		pSuspect, ok := g.Players[*a.Vote]
+		if !ok {
+			WarnLogger.Println("could not find player to vote for:", *a.Vote)
+			reject("Vote", REJECT_UNKNOWN_PLAYER)
+			goto VoteNoOp
+		}
+
+		if !pSuspect.IsAlive {
+			WarnLogger.Println("attempt to vote for dead player:", a.PlayerId, *a.Vote)
+			reject("Vote", REJECT_TARGET_DEAD)
+			goto VoteNoOp
+		}
+
+		g.Meeting.Votes[p.PlayerId] = &pSuspect.PlayerId
+	}
+VoteNoOp:
+
+	return rejections
 }
 
-func (g *game) disconnectPlayer(playerId string) {
+// startMeeting moves the game into a meeting, assuming the lock is held
+func (g *game) startMeeting(calledBy string, reported *string) {
+	InfoLogger.Println("Meeting called:", g.GameId, calledBy)
+
+	// bodies are cleared from the map once a meeting is called
+	g.Bodies = make(map[string]*Body)
+
+	// players stand still until they send new inputs after the meeting
+	if g.Settings.AuthoritativeMovement {
+		for _, player := range g.Players {
+			player.Direction = ZERO_VECTOR
+		}
+	}
+
+	// tasks in progress are abandoned when a meeting starts
+	for _, task := range g.Tasks {
+		if !task.IsComplete {
+			task.Completer = nil
+			task.Start = nil
+		}
+	}
+
+	now := g.now
+	g.Status = MEETING
+	g.Meeting = &Meeting{
+		CalledBy: calledBy,
+		Reported: reported,
+		Phase:    DISCUSSION,
+		Votes:    make(map[string]*string),
+		Start:    Time{now},
+		PhaseEnd: Time{now.Add(g.Settings.DiscussionDuration.Duration)},
+	}
+}
+
+// updateMeeting advances the meeting through its phases according to the server clock
+func (g *game) updateMeeting() {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
-	// TODO: if game is not running, fully remove player
+	if g.Status != MEETING {
+		return
+	}
+
+	now := g.now
+	switch g.Meeting.Phase {
+	case DISCUSSION:
+		if now.After(g.Meeting.PhaseEnd.Time) {
+			g.Meeting.Phase = VOTING
+			g.Meeting.PhaseEnd = Time{now.Add(g.Settings.VotingDuration.Duration)}
+		}
+	case VOTING:
+		if now.After(g.Meeting.PhaseEnd.Time) || g.allVotesIn() {
+			g.tallyVotes()
+			g.Meeting.Phase = RESULTS
+			g.Meeting.PhaseEnd = Time{now.Add(g.Settings.ResultsDuration.Duration)}
+		}
+	case RESULTS:
+		if now.After(g.Meeting.PhaseEnd.Time) {
+			g.Status = IN_PROGRESS
+			g.Meeting = nil
+			g.resetKillCooldowns()
+		}
+	}
+}
+
+// allVotesIn checks whether every living, connected player has voted
+func (g *game) allVotesIn() bool {
+	for playerId, player := range g.Players {
+		if player.IsAlive && player.IsConnected {
+			if _, ok := g.Meeting.Votes[playerId]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// tallyVotes ejects the player with the most votes, unless skipping wins or there is a tie
+func (g *game) tallyVotes() {
+	counts := make(map[string]int)
+	skips := 0
+	for _, vote := range g.Meeting.Votes {
+		if vote == nil {
+			skips++
+		} else {
+			counts[*vote]++
+		}
+	}
+
+	var ejected *string
+	most := skips
+	tie := false
+	for playerId, count := range counts {
+		if count > most {
+			suspect := playerId
+			ejected = &suspect
+			most = count
+			tie = false
+		} else if count == most {
+			tie = true
+		}
+	}
+
+	if ejected == nil || tie {
+		InfoLogger.Println("Meeting ended without ejection:", g.GameId)
+		return
+	}
+
+	InfoLogger.Println("Player ejected:", g.GameId, *ejected)
+	g.Players[*ejected].IsAlive = false
+	g.Meeting.Ejected = ejected
+}
+
+func (g *game) disconnectPlayer(playerId string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 
 	InfoLogger.Println("Disconnect player:", playerId)
+	g.record(&logEntry{Kind: LOG_DISCONNECT, PlayerId: playerId})
 
 	p := g.Players[playerId]
 	if p != nil {
@@ -480,13 +1098,34 @@ func (g *game) disconnectPlayer(playerId string) {
 	} else {
 		ErrorLogger.Println("disconnectPlayer could not find player:", playerId)
 	}
+
+	// players leaving the lobby free up their spot
+	if g.Status == LOBBY {
+		delete(g.Players, playerId)
+	}
+
+	if g.HostId == playerId {
+		g.passHost()
+	}
+}
+
+// passHost hands the host role to another connected player, assuming the lock is held
+func (g *game) passHost() {
+	g.HostId = ""
+	for _, playerId := range g.playerIds() {
+		if g.Players[playerId].IsConnected {
+			g.HostId = playerId
+			InfoLogger.Println("New host:", g.GameId, playerId)
+			return
+		}
+	}
 }
 
 func (g *game) checkEndOfGame() {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
-	if g.Status != IN_PROGRESS {
+	if g.Status != IN_PROGRESS && g.Status != MEETING {
 		return
 	}
 
@@ -514,7 +1153,7 @@ func (g *game) checkEndOfGame() {
 			completedTasks++
 		}
 	}
-	if completedTasks == 6 {
+	if completedTasks >= g.Settings.TasksToWin {
 		g.Status = CREWMATES_WIN
 	}
 }
@@ -527,17 +1166,36 @@ func (g *game) start() {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
+	if g.Status != LOBBY {
+		return
+	}
+
+	g.startLocked()
+	// the server starts full lobbies between steps, which are not logged while nothing happens in a lobby
+	g.record(&logEntry{Kind: LOG_START, Tick: g.simTick, Now: &Time{g.now}})
+}
+
+// startLocked assigns roles and starting positions, assuming the lock is held
+func (g *game) startLocked() {
+	seed := time.Now().UnixNano()
+	if g.replaySeed != nil {
+		seed = *g.replaySeed
+	}
+	g.startSeed = &seed
+	rng := rand.New(rand.NewSource(seed))
+
 	// choose impostors and prevent duplicates
-	impostor1, impostor2 := rand.Intn(len(g.Players)), rand.Intn(len(g.Players))
-	for impostor1 == impostor2 {
-		impostor2 = rand.Intn(len(g.Players))
+	impostors := make(map[int]bool, g.Settings.NumImpostors)
+	for _, i := range rng.Perm(len(g.Players))[:g.Settings.NumImpostors] {
+		impostors[i] = true
 	}
 
-	// set chosen players as impostors and choose start positions
+	// set chosen players as impostors and choose start positions, in an order a replay can repeat
 	i := 0
 	startAngle := 0.0
-	for _, player := range g.Players {
-		if i == impostor1 || i == impostor2 {
+	for _, playerId := range g.playerIds() {
+		player := g.Players[playerId]
+		if impostors[i] {
 			player.IsImpostor = true
 		}
 
@@ -546,15 +1204,36 @@ func (g *game) start() {
 
 		player.Color = "#" + COLORS[i]
 
-		player.LastHeard = Time{time.Now()}
+		if g.Settings.AuthoritativeMovement {
+			player.Direction = ZERO_VECTOR
+		}
+
+		player.LastHeard = Time{g.now}
+		g.recordPosition(player, player.LastHeard.Time)
+
+		player.MeetingsLeft = g.Settings.EmergencyMeetings
 
 		i += 1
 	}
 
+	// start the round with a clean map
+	g.Bodies = make(map[string]*Body)
+	g.resetKillCooldowns()
+
 	// signal that game has started
 	g.Status = IN_PROGRESS
 }
 
+// playerIds lists the ids of the players in a fixed order, assuming the lock is held
+func (g *game) playerIds() []string {
+	playerIds := make([]string, 0, len(g.Players))
+	for playerId := range g.Players {
+		playerIds = append(playerIds, playerId)
+	}
+	sort.Strings(playerIds)
+	return playerIds
+}
+
 func (t *Time) UnmarshalJSON(b []byte) error {
 	s, err := strconv.Unquote(string(b))
 	if err != nil {
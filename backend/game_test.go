@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// startedGame starts a game of client-authoritative movement with a full lobby, without its loop
+func startedGame(t *testing.T) *game {
+	settings := DEFAULT_SETTINGS
+	settings.MinPlayers = 3
+	settings.MaxPlayers = 4
+	settings.NumImpostors = 1
+
+	g := blankGame(nil, settings, loopTiming{TickRate: 60, SnapshotRate: 20})
+	g.now = serverNow()
+	g.addTasks()
+	for i := 0; i < settings.MaxPlayers; i++ {
+		if err := g.addPlayer(newPlayer("player")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g.start()
+
+	return g
+}
+
+// anyPlayer picks a player of a game
+func anyPlayer(g *game) *Player {
+	return g.Players[g.playerIds()[0]]
+}
+
+// TestMoveWithoutDirection checks that a move missing its direction is rejected, whichever
+// protocol it was sent with, instead of bringing down the game loop
+func TestMoveWithoutDirection(t *testing.T) {
+	g := startedGame(t)
+	p := anyPlayer(g)
+
+	for _, binary := range []bool{false, true} {
+		msg, err := encodeMessage(binary, map[string]interface{}{
+			"ActionId":  1,
+			"Position":  p.Position,
+			"Timestamp": Time{p.LastHeard.Time},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if binary {
+			if msg, err = msgpackToJSON(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var a *Action
+		if err := json.Unmarshal(msg, &a); err != nil {
+			t.Fatal(err)
+		}
+		a.PlayerId = p.PlayerId
+
+		rejections := g.performAction(a)
+		if len(rejections) != 1 || rejections[0].Reason != REJECT_INVALID_ACTION {
+			t.Fatalf("move without a direction was not rejected as invalid: %v", rejections)
+		}
+	}
+}
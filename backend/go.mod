@@ -1,4 +1,4 @@
-module main
+module amongus
 
 go 1.16
 
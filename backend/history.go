@@ -0,0 +1,101 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// fewest positions kept per player, which positions sent by clients may fill faster than steps
+	POSITION_HISTORY = 32
+	MAX_REWIND       = 200 * time.Millisecond
+)
+
+type positionSample struct {
+	time     time.Time
+	position Vector
+}
+
+// positionHistory is a ring buffer of the latest positions of a player
+type positionHistory struct {
+	samples []positionSample
+	next    int
+	count   int
+}
+
+func newPositionHistory(size int) *positionHistory {
+	return &positionHistory{samples: make([]positionSample, size)}
+}
+
+// historySize is how many positions to keep so that twice MAX_REWIND is covered
+// when one is recorded every step, and never fewer than POSITION_HISTORY
+func (t *loopTiming) historySize() int {
+	if n := 2*int(MAX_REWIND/t.step()) + 1; n > POSITION_HISTORY {
+		return n
+	}
+	return POSITION_HISTORY
+}
+
+func (h *positionHistory) record(t time.Time, position Vector) {
+	size := len(h.samples)
+	h.samples[h.next] = positionSample{time: t, position: position}
+	h.next = (h.next + 1) % size
+	if h.count < size {
+		h.count++
+	}
+}
+
+// at interpolates the position at the given time, clamping to the oldest sample
+func (h *positionHistory) at(t time.Time) (Vector, bool) {
+	if h.count == 0 {
+		return ZERO_VECTOR, false
+	}
+
+	size := len(h.samples)
+	newer := h.samples[(h.next-1+size)%size]
+	if !t.Before(newer.time) {
+		return newer.position, true
+	}
+
+	for i := 2; i <= h.count; i++ {
+		older := h.samples[(h.next-i+size)%size]
+		if !t.Before(older.time) {
+			span := newer.time.Sub(older.time)
+			if span <= 0 {
+				return older.position, true
+			}
+			fraction := float64(t.Sub(older.time)) / float64(span)
+			return older.position.add(newer.position.sub(older.position).mul(fraction)), true
+		}
+		newer = older
+	}
+
+	return newer.position, true
+}
+
+// recordPosition stores the current position of a player in its history, assuming the lock is held
+func (g *game) recordPosition(p *Player, t time.Time) {
+	h, ok := g.history[p.PlayerId]
+	if !ok {
+		h = newPositionHistory(g.timing.historySize())
+		g.history[p.PlayerId] = h
+	}
+	h.record(t, p.Position)
+}
+
+// rewindPosition estimates where a player was at the given time, looking back at most MAX_REWIND
+func (g *game) rewindPosition(p *Player, t time.Time) Vector {
+	now := g.now
+	if t.After(now) {
+		t = now
+	}
+	if now.Sub(t) > MAX_REWIND {
+		t = now.Add(-MAX_REWIND)
+	}
+
+	if h, ok := g.history[p.PlayerId]; ok {
+		if position, ok := h.at(t); ok {
+			return position
+		}
+	}
+	return p.Position
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRewindAtHighTickRate checks that a player moving every step can still be
+// rewound by MAX_REWIND when the game runs far more steps than usual
+func TestRewindAtHighTickRate(t *testing.T) {
+	timing := loopTiming{TickRate: 1000, SnapshotRate: 20}
+	h := newPositionHistory(timing.historySize())
+
+	start := time.Now()
+	steps := 2 * int(MAX_REWIND/timing.step())
+	for i := 0; i <= steps; i++ {
+		h.record(start.Add(time.Duration(i)*timing.step()), Vector{X: float64(i)})
+	}
+
+	now := start.Add(time.Duration(steps) * timing.step())
+	position, ok := h.at(now.Add(-MAX_REWIND))
+	if want := float64(steps) - float64(MAX_REWIND/timing.step()); !ok || position.X != want {
+		t.Fatalf("rewound to %v instead of %v", position.X, want)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+)
+
+// INPUT_QUEUE_LENGTH bounds the actions other than movement waiting for each player
+const INPUT_QUEUE_LENGTH = 8
+
+// inputQueue holds the actions of one player waiting for the next tick, in the order
+// they arrived, except that a movement supersedes a movement right before it
+type inputQueue struct {
+	updates []*gameUpdate
+	// actions other than movement among the updates
+	events int
+}
+
+// inputQueues gives each player its own queue, so that no player can delay the others' actions
+type inputQueues struct {
+	mu     sync.Mutex
+	queues map[string]*inputQueue
+	order  []string
+	next   int
+}
+
+func newInputQueues() *inputQueues {
+	return &inputQueues{
+		queues: make(map[string]*inputQueue),
+	}
+}
+
+// isMovement tells whether an update only moves the player, so that a newer one may replace it
+func isMovement(u *gameUpdate) bool {
+	return classify(u.action) == ACTION_MOVEMENT && u.clock == nil
+}
+
+// push queues an action, returning the movement it superseded if any, or false if the player's queue is full
+func (q *inputQueues) push(u *gameUpdate) (*gameUpdate, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	playerId := u.action.PlayerId
+	queue, ok := q.queues[playerId]
+	if !ok {
+		queue = &inputQueue{}
+		q.queues[playerId] = queue
+		q.order = append(q.order, playerId)
+	}
+
+	last := len(queue.updates) - 1
+	if isMovement(u) {
+		// a movement followed by other actions must be applied before them, so only the last one is replaced
+		if last >= 0 && isMovement(queue.updates[last]) {
+			superseded := queue.updates[last]
+			queue.updates[last] = u
+			return superseded, true
+		}
+		queue.updates = append(queue.updates, u)
+		return nil, true
+	}
+
+	if queue.events >= INPUT_QUEUE_LENGTH {
+		return nil, false
+	}
+	queue.updates = append(queue.updates, u)
+	queue.events++
+	return nil, true
+}
+
+// drain takes every queued action, one player at a time in turn, starting
+// with a different player every tick so that none is always served first
+func (q *inputQueues) drain() []*gameUpdate {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.order) == 0 {
+		return nil
+	}
+
+	updates := make([]*gameUpdate, 0, len(q.order))
+	start := q.next % len(q.order)
+	q.next = start + 1
+
+	for pending := true; pending; {
+		pending = false
+		for i := range q.order {
+			queue := q.queues[q.order[(start+i)%len(q.order)]]
+			if len(queue.updates) == 0 {
+				continue
+			}
+
+			u := queue.updates[0]
+			queue.updates[0] = nil
+			queue.updates = queue.updates[1:]
+			if !isMovement(u) {
+				queue.events--
+			}
+			updates = append(updates, u)
+
+			pending = pending || len(queue.updates) > 0
+		}
+	}
+
+	return updates
+}
+
+// remove drops the queue of a player who left, along with any action still in it
+func (q *inputQueues) remove(playerId string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.queues[playerId]; !ok {
+		return
+	}
+	delete(q.queues, playerId)
+	for i, id := range q.order {
+		if id == playerId {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func movementUpdate(playerId string, x float64) *gameUpdate {
+	return &gameUpdate{action: &Action{PlayerId: playerId, Position: &Vector{X: x}, Direction: &Vector{}}}
+}
+
+// TestDrainKeepsPlayerOrder checks that an action sent after a movement is applied after it
+func TestDrainKeepsPlayerOrder(t *testing.T) {
+	q := newInputQueues()
+	target := "victim"
+
+	first := movementUpdate("killer", 1)
+	kill := &gameUpdate{action: &Action{PlayerId: "killer", Kill: &target}}
+	second := movementUpdate("killer", 2)
+	for _, u := range []*gameUpdate{first, kill, second} {
+		if superseded, ok := q.push(u); !ok || superseded != nil {
+			t.Fatalf("push of %v: superseded %v, queued %v", u.action, superseded, ok)
+		}
+	}
+
+	updates := q.drain()
+	if len(updates) != 3 || updates[0] != first || updates[1] != kill || updates[2] != second {
+		t.Fatalf("drained out of order: %v", updates)
+	}
+}
+
+// TestMovementSupersedesMovement checks that only the latest of consecutive movements is kept
+func TestMovementSupersedesMovement(t *testing.T) {
+	q := newInputQueues()
+
+	first := movementUpdate("runner", 1)
+	second := movementUpdate("runner", 2)
+	q.push(first)
+	if superseded, ok := q.push(second); !ok || superseded != first {
+		t.Fatalf("expected the first movement to be superseded, got %v", superseded)
+	}
+
+	updates := q.drain()
+	if len(updates) != 1 || updates[0] != second {
+		t.Fatalf("expected only the latest movement, got %v", updates)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// steps run back to back to catch up after a stall, before the loop gives up and skips ahead
+	MAX_CATCHUP_STEPS = 5
+	// overruns are summed up in a single log line at most this often
+	OVERRUN_LOG_INTERVAL = 5 * time.Second
+)
+
+// loopTiming sets how many simulation steps a game runs per second, and how many snapshots it sends
+type loopTiming struct {
+	TickRate     int
+	SnapshotRate int
+}
+
+var DEFAULT_TIMING = loopTiming{
+	TickRate:     20,
+	SnapshotRate: 20,
+}
+
+// validate checks that snapshots line up with simulation steps
+func (t *loopTiming) validate() error {
+	if t.TickRate < 1 || t.TickRate > 1000 {
+		return fmt.Errorf("tick rate must be between 1 and 1000: %d", t.TickRate)
+	}
+
+	if t.SnapshotRate < 1 || t.SnapshotRate > t.TickRate || t.TickRate%t.SnapshotRate != 0 {
+		return fmt.Errorf("snapshot rate must divide the tick rate %d: %d", t.TickRate, t.SnapshotRate)
+	}
+
+	return nil
+}
+
+func (t *loopTiming) step() time.Duration {
+	return time.Second / time.Duration(t.TickRate)
+}
+
+// stepsPerSnapshot is how many simulation steps run between two snapshots
+func (t *loopTiming) stepsPerSnapshot() uint64 {
+	return uint64(t.TickRate / t.SnapshotRate)
+}
+
+// keyframeInterval is how many snapshots are sent in KEYFRAME_PERIOD, so that deltas never go on longer
+func (t *loopTiming) keyframeInterval() uint64 {
+	return uint64(time.Duration(t.SnapshotRate) * KEYFRAME_PERIOD / time.Second)
+}
+
+// overrunMonitor counts the steps that took longer than their time slot, or had to be skipped
+type overrunMonitor struct {
+	gameId  string
+	step    time.Duration
+	overrun int
+	skipped uint64
+	worst   time.Duration
+	lastLog time.Time
+}
+
+func newOverrunMonitor(gameId string, step time.Duration) *overrunMonitor {
+	return &overrunMonitor{
+		gameId:  gameId,
+		step:    step,
+		lastLog: time.Now(),
+	}
+}
+
+// record notes how long a step took
+func (m *overrunMonitor) record(elapsed time.Duration) {
+	if elapsed > m.step {
+		m.overrun++
+		if elapsed > m.worst {
+			m.worst = elapsed
+		}
+	}
+	m.flush()
+}
+
+// skip notes steps dropped because the loop fell too far behind
+func (m *overrunMonitor) skip(steps uint64) {
+	m.skipped += steps
+	m.flush()
+}
+
+func (m *overrunMonitor) flush() {
+	if (m.overrun == 0 && m.skipped == 0) || time.Since(m.lastLog) < OVERRUN_LOG_INTERVAL {
+		return
+	}
+
+	WarnLogger.Printf("Tick overruns in game %s: %d steps over %v (worst %v), %d steps skipped",
+		m.gameId, m.overrun, m.step, m.worst, m.skipped)
+
+	m.overrun = 0
+	m.skipped = 0
+	m.worst = 0
+	m.lastLog = time.Now()
+}
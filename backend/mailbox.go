@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+)
+
+// mailbox holds the messages waiting to be written to a client: ordered events
+// are all kept, while only the newest snapshot is, since it supersedes older ones
+type mailbox struct {
+	mu       sync.Mutex
+	events   []message
+	snapshot *message
+	ready    chan struct{}
+}
+
+func newMailbox() *mailbox {
+	return &mailbox{
+		events: make([]message, 0, 4),
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push queues a message, replacing any snapshot the writer has not picked up yet
+func (m *mailbox) push(msg message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if msg.snapshot {
+		// never drop the final snapshot of a game
+		if m.snapshot != nil && m.snapshot.last {
+			return
+		}
+		m.snapshot = &msg
+	} else {
+		m.events = append(m.events, msg)
+	}
+
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop takes the next message to write, events first
+func (m *mailbox) pop() (message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var msg message
+	if len(m.events) > 0 {
+		msg = m.events[0]
+		m.events[0] = message{}
+		m.events = m.events[1:]
+	} else if m.snapshot != nil {
+		msg = *m.snapshot
+		m.snapshot = nil
+	} else {
+		return msg, false
+	}
+
+	return msg, true
+}
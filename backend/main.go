@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -55,7 +56,19 @@ func init() {
 
 func main() {
 	// Run main server loop and handle any unexpected errors
-	err := run()
+	var err error
+	switch mode := strings.ToLower(os.Getenv("MODE")); mode {
+	case "", "game":
+		err = run()
+	case "catalog":
+		err = runCatalog()
+	case "router":
+		err = runRouter()
+	case "replay":
+		err = runReplay()
+	default:
+		err = fmt.Errorf("unknown mode %q, expected game, catalog, router or replay", mode)
+	}
 	if err != nil {
 		ErrorLogger.Println(err)
 		panic(err)
@@ -64,14 +77,24 @@ func main() {
 
 func run() error {
 	// Listen to address
-	l, err := net.Listen("tcp", ADDRESS)
+	address := ADDRESS
+	envString("ADDRESS", &address)
+	l, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
 	}
 	fmt.Printf("Listening on http://%v\n", l.Addr())
 
 	// Setup http server and connect to address
-	s := newServer(l.Addr().(*net.TCPAddr).Port)
+	config, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+
+	s, err := newServer(l.Addr().(*net.TCPAddr).Port, config)
+	if err != nil {
+		return err
+	}
 	hs := &http.Server{
 		Handler:      s,
 		ReadTimeout:  time.Second * 10,
@@ -82,7 +105,105 @@ func run() error {
 		errc <- hs.Serve(l)
 	}()
 
-	// Handle signals
+	waitForSignal(errc)
+
+	// Upon signal, wait 10 seconds and force shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	if err := s.shutdown(ctx); err != nil {
+		WarnLogger.Println("Failed to shut down server:", err)
+	}
+
+	return hs.Shutdown(ctx)
+}
+
+// runCatalog serves as a catalog for game servers instead of hosting games
+func runCatalog() error {
+	config, err := loadCatalogConfig()
+	if err != nil {
+		return err
+	}
+
+	c := newCatalog(config.Lifetime)
+	return serveAnnounced(config.UDPAddress, config.HTTPAddress, c, c)
+}
+
+// runRouter sends players to game server nodes instead of hosting games
+func runRouter() error {
+	config, err := loadRouterConfig()
+	if err != nil {
+		return err
+	}
+
+	r := newRouter(config)
+	return serveAnnounced(config.UDPAddress, config.HTTPAddress, r.nodes, r)
+}
+
+// runReplay rebuilds a game from its action log and prints the state it ended in
+func runReplay() error {
+	path := os.Getenv("REPLAY_LOG")
+	if path == "" {
+		return fmt.Errorf("replay needs the path of an action log in REPLAY_LOG")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	g, n, err := replayGame(f)
+	if err != nil {
+		return fmt.Errorf("replay of %v failed: %v", path, err)
+	}
+	InfoLogger.Println("Replayed", n, "entries of game", g.GameId, "up to tick", g.simTick)
+
+	state, err := json.MarshalIndent(g.GameState, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(state))
+	return nil
+}
+
+// serveAnnounced records the announcements of game servers in a catalog, while serving HTTP
+func serveAnnounced(udpAddress string, httpAddress string, c *catalog, handler http.Handler) error {
+	pc, err := net.ListenPacket("udp", udpAddress)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	l, err := net.Listen("tcp", httpAddress)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Listening on udp://%v and http://%v\n", pc.LocalAddr(), l.Addr())
+
+	hs := &http.Server{
+		Handler:      handler,
+		ReadTimeout:  time.Second * 10,
+		WriteTimeout: time.Second * 10,
+	}
+	errc := make(chan error, 2)
+	go func() {
+		errc <- hs.Serve(l)
+	}()
+	go func() {
+		errc <- c.listen(pc)
+	}()
+
+	waitForSignal(errc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	return hs.Shutdown(ctx)
+}
+
+// waitForSignal blocks until the process is interrupted or a server fails
+func waitForSignal(errc chan error) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt)
 	select {
@@ -91,10 +212,4 @@ func run() error {
 	case sig := <-sigs:
 		WarnLogger.Printf("Terminating: %v\n", sig)
 	}
-
-	// Upon signal, wait 10 seconds and force shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
-
-	return hs.Shutdown(ctx)
 }
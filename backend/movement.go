@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// largest distance moved at once before checking the navmesh again
+const MOVE_STEP = 2.0
+
+// integrateMovement moves every player along their latest input direction
+func (g *game) integrateMovement(dt time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.Settings.AuthoritativeMovement || g.Status != IN_PROGRESS {
+		return
+	}
+
+	for _, player := range g.Players {
+		if !player.IsAlive || player.Direction.almostEqual(ZERO_VECTOR) {
+			continue
+		}
+
+		player.Position = moveAgainstNavmesh(player.Position, player.Direction.mul(g.Settings.MoveSpeed*dt.Seconds()))
+		g.recordPosition(player, g.now)
+	}
+}
+
+// moveAgainstNavmesh moves from a position by a displacement in small steps,
+// sliding along walls when the navmesh blocks the way
+func moveAgainstNavmesh(from Vector, displacement Vector) Vector {
+	steps := int(math.Ceil(math.Sqrt(displacement.squaredDistance(ZERO_VECTOR)) / MOVE_STEP))
+	if steps == 0 {
+		return from
+	}
+
+	step := displacement.mul(1.0 / float64(steps))
+	position := from
+	for i := 0; i < steps; i++ {
+		candidates := []Vector{
+			position.add(step),
+			position.add(Vector{X: step.X}),
+			position.add(Vector{Y: step.Y}),
+		}
+
+		moved := false
+		for _, candidate := range candidates {
+			if checkNavmesh(&candidate) {
+				position = candidate
+				moved = true
+				break
+			}
+		}
+
+		if !moved {
+			break
+		}
+	}
+
+	return position
+}
+
+// normalizeInput clamps an input direction to unit length
+func normalizeInput(input Vector) Vector {
+	length := math.Sqrt(input.squaredDistance(ZERO_VECTOR))
+	if length <= 1 {
+		return input
+	}
+	return input.mul(1.0 / length)
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// The binary protocol is MessagePack, with the same schema as the JSON messages:
+// outgoing values are encoded field by field the way encoding/json would, and
+// incoming messages are converted to JSON before being decoded as actions.
+// Only the subset of MessagePack needed to represent JSON is supported, plus
+// the timestamp extension that MessagePack libraries use for dates.
+
+var errMsgpackTruncated = errors.New("msgpack: unexpected end of message")
+
+// msgpackRaw is an already encoded MessagePack value, written as is
+type msgpackRaw []byte
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// encodeMessage marshals a message for a client, as MessagePack if it asked for the binary protocol
+func encodeMessage(binary bool, v interface{}) ([]byte, error) {
+	if binary {
+		return msgpackMarshal(v)
+	}
+	return json.Marshal(v)
+}
+
+// msgpackMarshal encodes a value as MessagePack, with the field names and values encoding/json would use
+func msgpackMarshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := msgpackEncodeValue(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func msgpackEncodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() || ((v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil()) {
+		buf.WriteByte(0xc0)
+		return nil
+	}
+
+	if raw, ok := v.Interface().(msgpackRaw); ok {
+		buf.Write(raw)
+		return nil
+	}
+
+	// types with their own JSON form, such as times and durations, keep it
+	if v.Type().Implements(jsonMarshalerType) {
+		b, err := v.Interface().(json.Marshaler).MarshalJSON()
+		if err != nil {
+			return err
+		}
+		packed, err := msgpackFromJSON(b)
+		if err != nil {
+			return err
+		}
+		buf.Write(packed)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return msgpackEncodeValue(buf, v.Elem())
+	case reflect.Bool:
+		return msgpackEncode(buf, v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		msgpackEncodeInt(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n := v.Uint(); n > math.MaxInt64 {
+			buf.WriteByte(0xcf)
+			binary.Write(buf, binary.BigEndian, n)
+		} else {
+			msgpackEncodeInt(buf, int64(n))
+		}
+	case reflect.Float32, reflect.Float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v.Float()))
+	case reflect.String:
+		return msgpackEncode(buf, v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		msgpackEncodeLength(buf, v.Len(), 0x90, 15, 0, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			if err := msgpackEncodeValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("msgpack: unsupported map key type %v", v.Type().Key())
+		}
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		msgpackEncodeLength(buf, v.Len(), 0x80, 15, 0, 0xde, 0xdf)
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := msgpackEncode(buf, iter.Key().String()); err != nil {
+				return err
+			}
+			if err := msgpackEncodeValue(buf, iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := make(map[string]reflect.Value)
+		names := msgpackStructFields(v, fields, nil)
+		msgpackEncodeLength(buf, len(names), 0x80, 15, 0, 0xde, 0xdf)
+		for _, name := range names {
+			if err := msgpackEncode(buf, name); err != nil {
+				return err
+			}
+			if err := msgpackEncodeValue(buf, fields[name]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+// msgpackStructFields collects the fields of a struct that encoding/json would
+// marshal, following its tags and flattening embedded structs
+func msgpackStructFields(v reflect.Value, fields map[string]reflect.Value, names []string) []string {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := v.Field(i)
+
+		if field.PkgPath != "" {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && field.Tag.Get("json") == "" {
+			names = msgpackStructFields(value, fields, names)
+			continue
+		}
+
+		name := field.Name
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		if tag[0] == "-" && len(tag) == 1 {
+			continue
+		}
+		if tag[0] != "" {
+			name = tag[0]
+		}
+		if len(tag) > 1 && tag[1] == "omitempty" && msgpackEmpty(value) {
+			continue
+		}
+
+		if _, ok := fields[name]; !ok {
+			names = append(names, name)
+		}
+		fields[name] = value
+	}
+	return names
+}
+
+// msgpackEmpty tells whether omitempty leaves a value out
+func msgpackEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Struct:
+		return false
+	}
+	return v.IsZero()
+}
+
+// msgpackFromJSON converts a JSON message to MessagePack
+func msgpackFromJSON(b []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(b))
+	if err := msgpackEncode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// msgpackToJSON converts a MessagePack message to JSON
+func msgpackToJSON(b []byte) ([]byte, error) {
+	v, rest, err := msgpackDecode(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("msgpack: %d trailing bytes", len(rest))
+	}
+	return json.Marshal(v)
+}
+
+func msgpackEncode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			msgpackEncodeInt(buf, i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		msgpackEncodeLength(buf, len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		msgpackEncodeLength(buf, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := msgpackEncode(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		msgpackEncodeLength(buf, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		for key, item := range v {
+			if err := msgpackEncode(buf, key); err != nil {
+				return err
+			}
+			if err := msgpackEncode(buf, item); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+func msgpackEncodeInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 127:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+// msgpackEncodeLength writes the header of a string, array or map, using the
+// fixed format when the length fits and the 8, 16 or 32 bit format otherwise
+func msgpackEncodeLength(buf *bytes.Buffer, n int, fixed byte, fixedMax int, format8 byte, format16 byte, format32 byte) {
+	switch {
+	case n <= fixedMax:
+		buf.WriteByte(fixed | byte(n))
+	case format8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(format8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(format16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(format32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func msgpackDecode(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errMsgpackTruncated
+	}
+
+	format, b := b[0], b[1:]
+	switch {
+	case format <= 0x7f:
+		return int64(format), b, nil
+	case format >= 0xe0:
+		return int64(int8(format)), b, nil
+	case format >= 0x80 && format <= 0x8f:
+		return msgpackDecodeMap(b, int(format&0x0f))
+	case format >= 0x90 && format <= 0x9f:
+		return msgpackDecodeArray(b, int(format&0x0f))
+	case format >= 0xa0 && format <= 0xbf:
+		return msgpackDecodeString(b, int(format&0x1f))
+	}
+
+	switch format {
+	case 0xc0:
+		return nil, b, nil
+	case 0xc2:
+		return false, b, nil
+	case 0xc3:
+		return true, b, nil
+	case 0xc4, 0xd9:
+		n, b, err := msgpackDecodeUint(b, 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackDecodeString(b, int(n))
+	case 0xc5, 0xda:
+		n, b, err := msgpackDecodeUint(b, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackDecodeString(b, int(n))
+	case 0xc6, 0xdb:
+		n, b, err := msgpackDecodeUint(b, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackDecodeString(b, int(n))
+	case 0xca:
+		n, b, err := msgpackDecodeUint(b, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		return float64(math.Float32frombits(uint32(n))), b, nil
+	case 0xcb:
+		n, b, err := msgpackDecodeUint(b, 8)
+		if err != nil {
+			return nil, nil, err
+		}
+		return math.Float64frombits(n), b, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, b, err := msgpackDecodeUint(b, 1<<(format-0xcc))
+		if err != nil {
+			return nil, nil, err
+		}
+		return n, b, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (format - 0xd0)
+		n, b, err := msgpackDecodeUint(b, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		shift := uint(64 - 8*size)
+		return int64(n<<shift) >> shift, b, nil
+	case 0xd6, 0xd7, 0xc7:
+		return msgpackDecodeTimestamp(format, b)
+	case 0xdc:
+		n, b, err := msgpackDecodeUint(b, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackDecodeArray(b, int(n))
+	case 0xdd:
+		n, b, err := msgpackDecodeUint(b, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackDecodeArray(b, int(n))
+	case 0xde:
+		n, b, err := msgpackDecodeUint(b, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackDecodeMap(b, int(n))
+	case 0xdf:
+		n, b, err := msgpackDecodeUint(b, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackDecodeMap(b, int(n))
+	}
+
+	return nil, nil, fmt.Errorf("msgpack: unsupported format 0x%x", format)
+}
+
+func msgpackDecodeUint(b []byte, size int) (uint64, []byte, error) {
+	if len(b) < size {
+		return 0, nil, errMsgpackTruncated
+	}
+	var n uint64
+	for _, c := range b[:size] {
+		n = n<<8 | uint64(c)
+	}
+	return n, b[size:], nil
+}
+
+func msgpackDecodeString(b []byte, n int) (interface{}, []byte, error) {
+	if n < 0 || len(b) < n {
+		return nil, nil, errMsgpackTruncated
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+func msgpackDecodeArray(b []byte, n int) (interface{}, []byte, error) {
+	if n < 0 || n > len(b) {
+		return nil, nil, errMsgpackTruncated
+	}
+	items := make([]interface{}, n)
+	for i := range items {
+		var err error
+		if items[i], b, err = msgpackDecode(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	return items, b, nil
+}
+
+func msgpackDecodeMap(b []byte, n int) (interface{}, []byte, error) {
+	if n < 0 || 2*n > len(b) {
+		return nil, nil, errMsgpackTruncated
+	}
+	items := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, rest, err := msgpackDecode(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyString, ok := key.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("msgpack: unsupported map key %v", key)
+		}
+		if items[keyString], b, err = msgpackDecode(rest); err != nil {
+			return nil, nil, err
+		}
+	}
+	return items, b, nil
+}
+
+// msgpackDecodeTimestamp decodes the timestamp extension into the time format used by JSON messages
+func msgpackDecodeTimestamp(format byte, b []byte) (interface{}, []byte, error) {
+	size := 4
+	switch format {
+	case 0xd7:
+		size = 8
+	case 0xc7:
+		n, rest, err := msgpackDecodeUint(b, 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		size, b = int(n), rest
+	}
+
+	if len(b) < 1+size {
+		return nil, nil, errMsgpackTruncated
+	}
+	if int8(b[0]) != -1 {
+		return nil, nil, fmt.Errorf("msgpack: unsupported extension type %d", int8(b[0]))
+	}
+	data, b := b[1:1+size], b[1+size:]
+
+	var t time.Time
+	switch size {
+	case 4:
+		seconds, _, _ := msgpackDecodeUint(data, 4)
+		t = time.Unix(int64(seconds), 0)
+	case 8:
+		n, _, _ := msgpackDecodeUint(data, 8)
+		t = time.Unix(int64(n&0x3ffffffff), int64(n>>34))
+	case 12:
+		nanos, _, _ := msgpackDecodeUint(data, 4)
+		seconds, _, _ := msgpackDecodeUint(data[4:], 8)
+		t = time.Unix(int64(seconds), int64(nanos))
+	default:
+		return nil, nil, fmt.Errorf("msgpack: invalid timestamp size %d", size)
+	}
+
+	return t.UTC().Format(RFC3999Micro), b, nil
+}
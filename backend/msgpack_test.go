@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// unpack decodes a MessagePack message the way a JSON message would be, to compare the two
+func unpack(t *testing.T, b []byte) interface{} {
+	converted, err := msgpackToJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unmarshal(t, converted)
+}
+
+func unmarshal(t *testing.T, b []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// packTimestamp encodes a time with the timestamp extension, in its 32, 64 or 96 bit format
+func packTimestamp(size int, t time.Time) []byte {
+	var buf bytes.Buffer
+	switch size {
+	case 4:
+		buf.Write([]byte{0xd6, 0xff})
+		binary.Write(&buf, binary.BigEndian, uint32(t.Unix()))
+	case 8:
+		buf.Write([]byte{0xd7, 0xff})
+		binary.Write(&buf, binary.BigEndian, uint64(t.Nanosecond())<<34|uint64(t.Unix()))
+	case 12:
+		buf.Write([]byte{0xc7, 12, 0xff})
+		binary.Write(&buf, binary.BigEndian, uint32(t.Nanosecond()))
+		binary.Write(&buf, binary.BigEndian, t.Unix())
+	}
+	return buf.Bytes()
+}
+
+// TestActionTimes checks that the times of an action decode alike whether they
+// were sent as strings or with any format of the timestamp extension
+func TestActionTimes(t *testing.T) {
+	ping := time.Date(2026, 10, 17, 12, 0, 0, 250000000, time.UTC)
+	pong := time.Date(2026, 10, 17, 12, 0, 1, 0, time.UTC)
+	sent := time.Date(2026, 10, 17, 12, 0, 1, 123456000, time.UTC)
+
+	for _, size := range []int{4, 8, 12} {
+		want := sent
+		if size == 4 {
+			want = sent.Truncate(time.Second)
+		}
+
+		pingString, err := msgpackMarshal(Time{ping})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		msgpackEncodeLength(&buf, 3, 0x80, 15, 0, 0xde, 0xdf)
+		msgpackEncode(&buf, "ActionId")
+		msgpackEncodeInt(&buf, 7)
+		msgpackEncode(&buf, "Timestamp")
+		buf.Write(packTimestamp(size, want))
+		msgpackEncode(&buf, "Pong")
+		msgpackEncodeLength(&buf, 2, 0x80, 15, 0, 0xde, 0xdf)
+		msgpackEncode(&buf, "Ping")
+		buf.Write(pingString)
+		msgpackEncode(&buf, "Time")
+		buf.Write(packTimestamp(size, pong))
+
+		converted, err := msgpackToJSON(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var a Action
+		if err := json.Unmarshal(converted, &a); err != nil {
+			t.Fatal(err)
+		}
+
+		if a.ActionId != 7 || !a.Timestamp.Equal(want) || a.Pong == nil ||
+			!a.Pong.Ping.Equal(ping) || !a.Pong.Time.Equal(pong) {
+			t.Fatalf("%d byte timestamps decoded as %s", size, converted)
+		}
+	}
+}
+
+// TestActionRoundTrip checks that an action survives being encoded as MessagePack and decoded again
+func TestActionRoundTrip(t *testing.T) {
+	kill := "victim"
+	a := Action{
+		PlayerId:  "player",
+		Position:  &Vector{X: 1.5, Y: -2},
+		Direction: &Vector{X: 0, Y: 1},
+		InputSeq:  1 << 40,
+		Kill:      &kill,
+		Settings:  &DEFAULT_SETTINGS,
+		Pong:      &Pong{Ping: Time{time.Unix(1, 1000)}, Time: Time{time.Unix(2, 0)}},
+		ActionId:  3,
+		Timestamp: Time{time.Date(2026, 10, 17, 12, 0, 0, 1000, time.UTC)},
+	}
+
+	packed, err := msgpackMarshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted, err := msgpackToJSON(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Action
+	if err := json.Unmarshal(converted, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("action decoded as %s instead of %s", got, want)
+	}
+}
+
+// bloodyGame is a started game with a body, a ghost and an impostor waiting out its cooldown
+func bloodyGame(t *testing.T) *game {
+	g := startedGame(t)
+	for _, playerId := range g.playerIds() {
+		p := g.Players[playerId]
+		if p.IsImpostor {
+			g.killReady[playerId] = g.now.Add(10 * time.Second)
+		} else if len(g.Bodies) == 0 {
+			p.IsAlive = false
+			g.Bodies[playerId] = &Body{PlayerId: playerId, Position: p.Position, TimeOfDeath: Time{g.now}}
+		}
+	}
+	g.Timestamp = &Time{g.now}
+	return g
+}
+
+// TestPackedView checks that every player's MessagePack view holds the same state as their JSON one
+func TestPackedView(t *testing.T) {
+	g := bloodyGame(t)
+	snap, err := g.newSnapshot(1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, playerId := range g.playerIds() {
+		p := g.Players[playerId]
+		f := snap.frame(g, p)
+
+		want := unmarshal(t, snap.view(g, p, f, g.now))
+		got := unpack(t, snap.packedView(g, p, f, g.now))
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("packed view of %v differs:\n%v\ninstead of\n%v", playerId, got, want)
+		}
+	}
+}
+
+// TestPackedDelta checks that a MessagePack delta holds the same changes as the JSON one
+func TestPackedDelta(t *testing.T) {
+	g := bloodyGame(t)
+	base, err := g.newSnapshot(1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make(map[string]*frame)
+	for _, playerId := range g.playerIds() {
+		frames[playerId] = base.frame(g, g.Players[playerId])
+	}
+
+	for _, p := range g.Players {
+		p.Position = p.Position.add(Vector{X: 3})
+	}
+	for _, task := range g.Tasks {
+		task.IsComplete = true
+		break
+	}
+	g.Status = IMPOSTORS_WIN
+
+	snap, err := g.newSnapshot(2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, playerId := range g.playerIds() {
+		p := g.Players[playerId]
+		f := snap.frame(g, p)
+
+		jsonDelta, err := snap.delta(g, p, frames[playerId], f, g.now, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packedDelta, err := snap.delta(g, p, frames[playerId], f, g.now, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := unmarshal(t, jsonDelta)
+		got := unpack(t, packedDelta)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("packed delta of %v differs:\n%v\ninstead of\n%v", playerId, got, want)
+		}
+	}
+}
+
+// TestInvalidMessages checks that malformed messages are refused with an error rather than a panic
+func TestInvalidMessages(t *testing.T) {
+	g := bloodyGame(t)
+	snap, err := g.newSnapshot(1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := g.Players[g.playerIds()[0]]
+	valid := snap.packedView(g, p, snap.frame(g, p), g.now)
+
+	messages := [][]byte{
+		{0xc1},
+		{0x81, 0x01, 0x01},
+		{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0xdf, 0xff, 0xff, 0xff, 0xff},
+		{0xdb, 0xff, 0xff, 0xff, 0xff},
+		{0xd6, 0x01, 0, 0, 0, 0},
+		{0xc7, 5, 0xff, 1, 2, 3, 4, 5},
+		{0xcb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1},
+		{0xc0, 0xc0},
+	}
+	for n := range valid {
+		messages = append(messages, valid[:n])
+	}
+
+	for _, msg := range messages {
+		if _, err := msgpackToJSON(msg); err == nil {
+			t.Fatalf("message % x was accepted", msg)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Enum type to group actions that share a rate limit.
+type actionClass int
+
+const (
+	// positions and inputs, sent continuously while a player moves
+	ACTION_MOVEMENT actionClass = iota
+	// kills, tasks, meetings and votes
+	ACTION_INTERACTION
+	// pongs, acks and lobby management
+	ACTION_CONTROL
+)
+
+type actionLimit struct {
+	rate  rate.Limit
+	burst int
+}
+
+// the bundled client sends its position every 25 ms while moving, which movement must
+// stay well above, even when network jitter delivers several updates at once
+var ACTION_LIMITS = map[actionClass]actionLimit{
+	ACTION_MOVEMENT:    {rate: 50, burst: 50},
+	ACTION_INTERACTION: {rate: 5, burst: 10},
+	ACTION_CONTROL:     {rate: 30, burst: 30},
+}
+
+const (
+	// limited actions are counted over a window to decide how to escalate
+	RATE_VIOLATION_WINDOW = 10 * time.Second
+	RATE_WARN_VIOLATIONS  = 20
+	RATE_MAX_VIOLATIONS   = 200
+)
+
+// Enum type to describe what to do with an action once its rate was checked.
+type rateVerdict int
+
+const (
+	RATE_ALLOW rateVerdict = iota
+	RATE_DROP
+	RATE_WARN
+	RATE_DISCONNECT
+)
+
+// rateLimiter keeps the token buckets of a single connection, only ever used by its reader
+type rateLimiter struct {
+	limiters    map[actionClass]*rate.Limiter
+	violations  int
+	windowStart time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	limiters := make(map[actionClass]*rate.Limiter, len(ACTION_LIMITS))
+	for class, limit := range ACTION_LIMITS {
+		limiters[class] = rate.NewLimiter(limit.rate, limit.burst)
+	}
+
+	return &rateLimiter{limiters: limiters}
+}
+
+// classify finds the budget an action is charged to, the scarcest one if it mixes several
+func classify(a *Action) actionClass {
+	if a.Kill != nil || a.StartTask != nil || a.CancelTask != nil || a.CompleteTask != nil ||
+		a.ReportBody != nil || a.CallMeeting || a.Vote != nil || a.SkipVote {
+		return ACTION_INTERACTION
+	}
+
+	if a.Position != nil || a.Direction != nil || a.Input != nil {
+		return ACTION_MOVEMENT
+	}
+
+	return ACTION_CONTROL
+}
+
+// allow charges an action to its budget, escalating as a client keeps going over it:
+// actions are dropped at first, the client is warned, and finally disconnected
+func (r *rateLimiter) allow(a *Action, now time.Time) rateVerdict {
+	if r.limiters[classify(a)].AllowN(now, 1) {
+		return RATE_ALLOW
+	}
+
+	if now.Sub(r.windowStart) > RATE_VIOLATION_WINDOW {
+		r.windowStart = now
+		r.violations = 0
+	}
+	r.violations++
+
+	switch {
+	case r.violations >= RATE_MAX_VIOLATIONS:
+		return RATE_DISCONNECT
+	case r.violations == RATE_WARN_VIOLATIONS:
+		return RATE_WARN
+	default:
+		return RATE_DROP
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMovementAtClientRate checks that a client moving at the rate the bundled
+// client sends positions is never throttled, even when its updates arrive bunched up
+func TestMovementAtClientRate(t *testing.T) {
+	r := newRateLimiter()
+	a := &Action{Position: &Vector{X: 1, Y: 1}, Direction: &Vector{X: 1, Y: 0}}
+
+	now := time.Now()
+	for i := 0; i < 40*60; i++ {
+		// updates are sent every 25 ms, but every tenth second they arrive four at once
+		arrival := now.Add(time.Duration(i) * 25 * time.Millisecond)
+		if i%4 != 3 && (i/4)%10 == 0 {
+			arrival = now.Add(time.Duration(i-i%4+3) * 25 * time.Millisecond)
+		}
+
+		if verdict := r.allow(a, arrival); verdict != RATE_ALLOW {
+			t.Fatalf("update %d was throttled: %v", i, verdict)
+		}
+	}
+}
+
+// TestMovementFlood checks that a client sending positions far faster than any client would is cut off
+func TestMovementFlood(t *testing.T) {
+	r := newRateLimiter()
+	a := &Action{Position: &Vector{X: 1, Y: 1}, Direction: &Vector{X: 1, Y: 0}}
+
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		if r.allow(a, now.Add(time.Duration(i)*time.Millisecond)) == RATE_DISCONNECT {
+			return
+		}
+	}
+	t.Fatal("flooding client was never disconnected")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// REAP_INTERVAL is how often the server looks for abandoned games
+const REAP_INTERVAL = 10 * time.Second
+
+// gameRegistry tracks every live game from creation until its loop quits
+type gameRegistry struct {
+	games      map[string]*game
+	emptySince map[string]time.Time
+}
+
+func newGameRegistry() *gameRegistry {
+	return &gameRegistry{
+		games:      make(map[string]*game),
+		emptySince: make(map[string]time.Time),
+	}
+}
+
+// createGame starts a new game with default settings, unless the server already runs
+// as many games as it may, assuming the lock is held
+func (s *server) createGame() (*game, error) {
+	if len(s.games.games) >= s.config.MaxGames {
+		return nil, fmt.Errorf("server is full, %d games already running", len(s.games.games))
+	}
+
+	g, err := newGame(s.inbox, DEFAULT_SETTINGS, s.config.Timing, s.config.actionLogDir())
+	if err != nil {
+		return nil, err
+	}
+
+	s.games.games[g.GameId] = g
+	InfoLogger.Println("Created game:", g.GameId, len(s.games.games), "running")
+
+	return g, nil
+}
+
+// retireGame stops a game loop and forgets the game, assuming the lock is held
+func (s *server) retireGame(g *game) {
+	if _, ok := s.games.games[g.GameId]; !ok {
+		return
+	}
+	delete(s.games.games, g.GameId)
+	delete(s.games.emptySince, g.GameId)
+	s.forgetCheckpoint(g.GameId)
+
+	g.mu.RLock()
+	code := g.Code
+	g.mu.RUnlock()
+	if code != "" && s.lobbies[code] == g {
+		delete(s.lobbies, code)
+	}
+
+	// players waiting to reconnect have no game to come back to
+	for playerId, c := range s.staleClients {
+		if c.game == g {
+			c.staleTimer.Stop()
+			delete(s.staleClients, playerId)
+		}
+	}
+
+	// the game loop may be waiting on the server, which cannot make progress while the lock is held
+	InfoLogger.Println("Sending quit game:", g.GameId, len(s.games.games), "running")
+	go func() {
+		g.inbox <- &gameUpdate{quit: true}
+	}()
+}
+
+// reapGames periodically retires games nobody has been connected to for too long
+func (s *server) reapGames() {
+	ticker := time.NewTicker(REAP_INTERVAL)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.mu.Lock()
+		for gameId, g := range s.games.games {
+			// the public lobby waits for players for as long as it takes
+			if (g == s.nextGame && g.inLobby()) || g.connectedPlayers() > 0 {
+				delete(s.games.emptySince, gameId)
+				continue
+			}
+
+			since, ok := s.games.emptySince[gameId]
+			if !ok {
+				s.games.emptySince[gameId] = now
+			} else if now.Sub(since) > s.config.AbandonTimeout {
+				InfoLogger.Println("Reaping abandoned game:", gameId)
+				s.retireGame(g)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
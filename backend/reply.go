@@ -0,0 +1,73 @@
+package main
+
+// Enum type to describe why part of an action was rejected.
+type RejectReason string
+
+const (
+	REJECT_UNKNOWN_PLAYER      RejectReason = "UNKNOWN_PLAYER"
+	REJECT_INVALID_ACTION      RejectReason = "INVALID_ACTION"
+	REJECT_RATE_LIMITED        RejectReason = "RATE_LIMITED"
+	REJECT_QUEUE_FULL          RejectReason = "QUEUE_FULL"
+	REJECT_SUPERSEDED          RejectReason = "SUPERSEDED"
+	REJECT_NOT_ALIVE           RejectReason = "NOT_ALIVE"
+	REJECT_NOT_IN_PROGRESS     RejectReason = "NOT_IN_PROGRESS"
+	REJECT_NOT_IN_LOBBY        RejectReason = "NOT_IN_LOBBY"
+	REJECT_WRONG_MOVEMENT_MODE RejectReason = "WRONG_MOVEMENT_MODE"
+	REJECT_TOO_FAST            RejectReason = "TOO_FAST"
+	REJECT_OUT_OF_BOUNDS       RejectReason = "OUT_OF_BOUNDS"
+	REJECT_OUT_OF_ORDER        RejectReason = "OUT_OF_ORDER"
+	REJECT_NOT_IMPOSTOR        RejectReason = "NOT_IMPOSTOR"
+	REJECT_TARGET_IMPOSTOR     RejectReason = "TARGET_IMPOSTOR"
+	REJECT_TARGET_DEAD         RejectReason = "TARGET_DEAD"
+	REJECT_COOLDOWN            RejectReason = "COOLDOWN"
+	REJECT_TOO_FAR             RejectReason = "TOO_FAR"
+	REJECT_TOO_EARLY           RejectReason = "TOO_EARLY"
+	REJECT_UNKNOWN_TASK        RejectReason = "UNKNOWN_TASK"
+	REJECT_TASK_COMPLETED      RejectReason = "TASK_COMPLETED"
+	REJECT_TASK_STARTED        RejectReason = "TASK_STARTED"
+	REJECT_TASK_NOT_STARTED    RejectReason = "TASK_NOT_STARTED"
+	REJECT_TASK_TAKEN          RejectReason = "TASK_TAKEN"
+	REJECT_NOT_HOST            RejectReason = "NOT_HOST"
+	REJECT_PUBLIC_LOBBY        RejectReason = "PUBLIC_LOBBY"
+	REJECT_INVALID_SETTINGS    RejectReason = "INVALID_SETTINGS"
+	REJECT_TOO_FEW_PLAYERS     RejectReason = "TOO_FEW_PLAYERS"
+	REJECT_NO_MEETINGS_LEFT    RejectReason = "NO_MEETINGS_LEFT"
+	REJECT_UNKNOWN_BODY        RejectReason = "UNKNOWN_BODY"
+	REJECT_NOT_VOTING          RejectReason = "NOT_VOTING"
+	REJECT_ALREADY_VOTED       RejectReason = "ALREADY_VOTED"
+)
+
+// Rejection names the field of an action that was not applied and why
+type Rejection struct {
+	Action string
+	Reason RejectReason
+}
+
+// ActionReply is sent to a player for every action carrying an id; an empty
+// list of errors means the whole action was applied
+type ActionReply struct {
+	ActionId uint64
+	Errors   []Rejection
+}
+
+// reply tells a player which parts of its action were rejected, if it asked for a reply;
+// replies are sent along with the next snapshot, so the game loop never waits on the server
+func (g *game) reply(a *Action, rejections []Rejection) {
+	if a.ActionId == 0 {
+		return
+	}
+
+	msg, err := encodeMessage(g.isBinary(a.PlayerId), ActionReply{ActionId: a.ActionId, Errors: rejections})
+	if err != nil {
+		ErrorLogger.Println("reply failed to marshall action reply:", err)
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.replies == nil {
+		g.replies = make(map[string][][]byte)
+	}
+	g.replies[a.PlayerId] = append(g.replies[a.PlayerId], msg)
+}
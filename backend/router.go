@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ROUTER_QUERY_TIMEOUT bounds how long the router waits for nodes to tell whether they own a lobby or player
+const ROUTER_QUERY_TIMEOUT = 2 * time.Second
+
+// router sends each connecting player to one of several game server nodes: new
+// lobbies go to the least loaded node, and lobby codes and resumed sessions to the
+// node holding them. Nodes report their load by announcing themselves to the router
+// as they would to a catalog, and drop out of the table when they stop.
+type router struct {
+	nodes    *catalog
+	redirect bool
+	client   *http.Client
+	serveMux http.ServeMux
+}
+
+func newRouter(config routerConfig) *router {
+	r := &router{
+		nodes:    newCatalog(config.Lifetime),
+		redirect: config.Redirect,
+		client:   &http.Client{Timeout: ROUTER_QUERY_TIMEOUT},
+	}
+	r.serveMux.HandleFunc("/connect", r.connectHandler)
+	r.serveMux.HandleFunc("/nodes", r.nodes.queryHandler)
+	r.serveMux.HandleFunc("/query.json", r.queryHandler)
+
+	return r
+}
+
+// ServeHTTP implements the required interface for an http server
+func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.serveMux.ServeHTTP(w, req)
+}
+
+// connectHandler picks the node a player belongs on, then proxies or redirects the websocket to it
+func (r *router) connectHandler(w http.ResponseWriter, req *http.Request) {
+	var node *catalogEntry
+	if playerId := requestParam(req, "id"); playerId != "" {
+		node = r.findOwner(req.Context(), "id", playerId)
+	} else if code := requestParam(req, "code"); code != "" {
+		node = r.findOwner(req.Context(), "code", code)
+	} else if requestParam(req, "create") != "" {
+		node = r.leastLoaded(false)
+	} else {
+		node = r.leastLoaded(true)
+	}
+
+	if node == nil {
+		WarnLogger.Println("Router found no node for connection from", req.RemoteAddr)
+		http.Error(w, "no game server available", http.StatusServiceUnavailable)
+		return
+	}
+
+	key := catalogKey(node.Address, node.Port)
+	// the query string may hold a resume token, so it is kept out of the logs
+	InfoLogger.Println("Router sending connection from", req.RemoteAddr, "to", key)
+
+	if r.redirect {
+		http.Redirect(w, req, "ws://"+key+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+
+	// the reverse proxy passes websocket upgrades through as they are
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: key})
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		WarnLogger.Println("Router failed to reach node:", key, err)
+		r.nodes.remove(key)
+		http.Error(w, "game server unavailable", http.StatusBadGateway)
+	}
+	proxy.ServeHTTP(w, req)
+}
+
+// leastLoaded picks the node with the lowest share of its games in use for a new lobby; the
+// public lobby instead goes to the node whose public lobby has the most players waiting, so
+// that games fill up. The pick counts against the node until it reports again.
+func (r *router) leastLoaded(public bool) *catalogEntry {
+	r.nodes.mu.Lock()
+	defer r.nodes.mu.Unlock()
+
+	var best *catalogEntry
+	for _, node := range r.nodes.listLocked(time.Now()) {
+		if node.Type != "game" {
+			continue
+		}
+		if public && node.Waiting > 0 {
+			if best == nil || node.Waiting > best.Waiting {
+				best = node
+			}
+			continue
+		}
+		if public && best != nil && best.Waiting > 0 {
+			continue
+		}
+		if node.MaxGames > 0 && node.Games >= node.MaxGames {
+			continue
+		}
+		if best == nil || loadBelow(node, best) {
+			best = node
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	claimed := *best
+	if public {
+		claimed.Waiting++
+	} else {
+		claimed.Games++
+	}
+	r.nodes.entries[catalogKey(best.Address, best.Port)] = &claimed
+
+	return best
+}
+
+// loadBelow compares the load of two nodes, by share of games then by number of players
+func loadBelow(a *catalogEntry, b *catalogEntry) bool {
+	loadA, loadB := float64(a.Games), float64(b.Games)
+	if a.MaxGames > 0 && b.MaxGames > 0 {
+		loadA, loadB = loadA/float64(a.MaxGames), loadB/float64(b.MaxGames)
+	}
+	if loadA != loadB {
+		return loadA < loadB
+	}
+	return a.Players < b.Players
+}
+
+// findOwner asks every node at once whether it holds a lobby code or player, returning the first that does
+func (r *router) findOwner(ctx context.Context, param string, value string) *catalogEntry {
+	ctx, cancel := context.WithTimeout(ctx, ROUTER_QUERY_TIMEOUT)
+	defer cancel()
+
+	nodes := r.nodes.list(time.Now())
+	owners := make(chan *catalogEntry, len(nodes))
+	for _, node := range nodes {
+		go func(node *catalogEntry) {
+			query := url.Values{param: []string{value}}
+			u := url.URL{Scheme: "http", Host: catalogKey(node.Address, node.Port), Path: "/owns", RawQuery: query.Encode()}
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+			if err != nil {
+				owners <- nil
+				return
+			}
+			resp, err := r.client.Do(req)
+			if err != nil {
+				owners <- nil
+				return
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode == http.StatusNoContent {
+				owners <- node
+			} else {
+				owners <- nil
+			}
+		}(node)
+	}
+
+	for range nodes {
+		if owner := <-owners; owner != nil {
+			return owner
+		}
+	}
+	return nil
+}
+
+// queryHandler lists the router itself in the catalog format, so that the frontend connects through it
+func (r *router) queryHandler(w http.ResponseWriter, req *http.Request) {
+	host, portString, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, portString = req.Host, "80"
+	}
+	port, _ := strconv.Atoi(portString)
+
+	msg, err := json.Marshal([]*catalogEntry{{
+		CatalogAnnounce: CatalogAnnounce{
+			Type:    "router",
+			Port:    port,
+			Project: "amongus",
+			Version: VERSION,
+		},
+		Address:   host,
+		LastHeard: time.Now().Unix(),
+	}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(msg)
+}
@@ -2,76 +2,146 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"net"
+	"fmt"
+	mathrand "math/rand"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	// "golang.org/x/time/rate"
-
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 type server struct {
 	clients      map[string]*client
 	staleClients map[string]*client
+	games        *gameRegistry
 	nextGame     *game
-
-	mu       sync.Mutex
-	inbox    chan *serverUpdate
-	serveMux http.ServeMux
-	// rateLimiter *rate.Limiter
+	lobbies      map[string]*game
+
+	config       serverConfig
+	discovery    discovery
+	done         chan struct{}
+	deregistered chan struct{}
+	mu           sync.Mutex
+	inbox        chan *serverUpdate
+	serveMux     http.ServeMux
 }
 
 type client struct {
 	player       *Player
 	game         *game
-	out          chan message
+	resumeToken  string
+	mailbox      *mailbox
+	lastRead     int64
 	conn         *websocket.Conn
+	binary       bool
 	rwTerminate  func()
 	rwWg         sync.WaitGroup
+	clock        clock
+	limiter      *rateLimiter
 	disconnected bool
+	staleTimer   *time.Timer
+	// when the player is dropped from the game unless it reconnects, once the client is stale
+	staleUntil time.Time
 }
 
 type serverUpdate struct {
-	gameState []byte
-	playerIds []string
-	endgame   *game
+	gameStates map[string][]byte
+	replies    map[string][][]byte
+	endgame    *game
 }
 
 type message struct {
-	content []byte
-	last    bool
+	content  []byte
+	snapshot bool
+	last     bool
 }
 
-type CatalogAnnounce struct {
-	Type    string `json:"type"`
-	Owner   string `json:"owner"`
-	Port    int    `json:"port"`
-	Project string `json:"project"`
+type resumeMessage struct {
+	ResumeToken string
 }
 
+const RECONNECT_GRACE = 30 * time.Second
+
+// END_GAME_TIMEOUT bounds how long a finished game waits for its last state to reach its players
+const END_GAME_TIMEOUT = 10 * time.Second
+
+// JSON is used when the client does not ask for a subprotocol
+const (
+	SUBPROTOCOL_JSON    = "json"
+	SUBPROTOCOL_MSGPACK = "msgpack"
+)
+
+const (
+	LOBBY_CODE_LENGTH   = 5
+	LOBBY_CODE_ALPHABET = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
 // newServer initializes a new http server for the game backend
-func newServer(port int) *server {
-	inbox := make(chan *serverUpdate, 16)
+func newServer(port int, config serverConfig) (*server, error) {
+	discovery, err := newDiscovery(config)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &server{
 		clients:      make(map[string]*client),
 		staleClients: make(map[string]*client),
-		nextGame:     newGame(inbox),
-		inbox:        inbox,
-		// rateLimiter:  rate.NewLimiter(rate.Every(1*time.Millisecond), 8), // TODO: change this
+		games:        newGameRegistry(),
+		lobbies:      make(map[string]*game),
+		config:       config,
+		discovery:    discovery,
+		done:         make(chan struct{}),
+		deregistered: make(chan struct{}),
+		inbox:        make(chan *serverUpdate, 16),
 	}
+
+	nextGame, err := s.createGame()
+	if err != nil {
+		return nil, err
+	}
+	s.nextGame = nextGame
+
+	if config.CheckpointInterval > 0 {
+		if err := s.restoreGames(); err != nil {
+			return nil, err
+		}
+	}
+
 	// s.serveMux.Handle("/", http.FileServer(http.Dir(".")))
 	s.serveMux.HandleFunc("/connect", s.connectHandler)
+	s.serveMux.HandleFunc("/owns", s.ownsHandler)
 
 	go s.watch()
 
+	go s.reapGames()
+
+	if config.CheckpointInterval > 0 {
+		go s.checkpointGames()
+	}
+
 	go s.announce(port)
 
-	return s
+	return s, nil
+}
+
+// shutdown stops advertising the server, waiting for it to be deregistered
+func (s *server) shutdown(ctx context.Context) error {
+	close(s.done)
+
+	select {
+	case <-s.deregistered:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // ServeHTTP implements the required interface for an http server
@@ -83,6 +153,7 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (s *server) connectHandler(w http.ResponseWriter, r *http.Request) {
 	// Using OriginPatterns is probably safer than ignoring verification.
 	options := &websocket.AcceptOptions{
+		Subprotocols:       []string{SUBPROTOCOL_MSGPACK, SUBPROTOCOL_JSON},
 		InsecureSkipVerify: true,
 		//OriginPatterns: []string{"localhost:3000"},
 	}
@@ -93,17 +164,17 @@ func (s *server) connectHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	name := r.URL.Query().Get("name")
-	if name == "" {
-		name = r.Header.Get("name")
-	}
+	name := requestParam(r, "name")
+	playerId := requestParam(r, "id")
+	token := requestParam(r, "token")
+	code := requestParam(r, "code")
+	create := requestParam(r, "create") != ""
 
-	playerId := r.URL.Query().Get("id")
-	if playerId == "" {
-		playerId = r.Header.Get("id")
+	if playerId != "" {
+		err = s.reconnect(r.Context(), c, playerId, token)
+	} else {
+		err = s.connect(r.Context(), c, name, code, create)
 	}
-
-	err = s.connect(r.Context(), c, name)
 	if errors.Is(err, context.Canceled) {
 		return
 	}
@@ -117,94 +188,267 @@ func (s *server) connectHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *server) announce(port int) {
-	ticker := time.NewTicker(60 * time.Second) // 1/60s
-	defer ticker.Stop()
-
-	_announce := func() {
-		conn, err := net.DialTimeout("udp", "catalog.cse.nd.edu:9097", 10*time.Second)
-		if err != nil {
-			return
-		}
-		defer conn.Close()
-
-		msg := CatalogAnnounce{
-			Type:    "game",
-			Owner:   "gsilvasi,rdestefa",
-			Port:    port,
-			Project: "amongus",
-		}
+// requestParam reads a connection parameter from the query string, or else from the headers
+func requestParam(r *http.Request, key string) string {
+	if value := r.URL.Query().Get(key); value != "" {
+		return value
+	}
+	return r.Header.Get(key)
+}
 
-		msgBytes, err := json.Marshal(msg)
-		if err != nil {
-			return
-		}
+// ownsHandler answers whether this node holds the open lobby with a code, or the session of a player,
+// so that a router knows where to send them
+func (s *server) ownsHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		conn.Write(msgBytes)
+	owns := false
+	if code := strings.ToUpper(r.URL.Query().Get("code")); code != "" {
+		g, ok := s.lobbies[code]
+		owns = ok && g.inLobby()
+	} else if playerId := r.URL.Query().Get("id"); playerId != "" {
+		_, connected := s.clients[playerId]
+		_, stale := s.staleClients[playerId]
+		owns = connected || stale
 	}
 
-	_announce()
-	for range ticker.C {
-		_announce()
+	if owns {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
 	}
 }
 
 // connect establishes a writer and a reader for a websocket connection
-func (s *server) connect(ctx context.Context, conn *websocket.Conn, name string) error {
-	// TODO: handle client is reconnecting
-
+func (s *server) connect(ctx context.Context, conn *websocket.Conn, name string, code string, create bool) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	token, err := newResumeToken()
+	if err != nil {
+		conn.Close(websocket.StatusInternalError, err.Error())
+		return err
+	}
+
 	c := &client{
-		player: newPlayer(name),
-		out:    make(chan message, 16),
-		conn:   conn,
+		player:      newPlayer(name),
+		resumeToken: token,
+		mailbox:     newMailbox(),
+		limiter:     newRateLimiter(),
+		conn:        conn,
+		binary:      conn.Subprotocol() == SUBPROTOCOL_MSGPACK,
 	}
 
 	InfoLogger.Println("Connect player:", c.player.PlayerId)
 
+	// find the lobby the player asked for
+	g, err := s.findLobby(code, create)
+	if err != nil {
+		c.conn.Close(websocket.StatusPolicyViolation, err.Error())
+		return err
+	}
+
 	// add new player
-	if err := s.nextGame.addPlayer(c.player); err != nil {
-		close(c.out)
+	if err := g.addPlayer(c.player); err != nil {
 		c.conn.Close(websocket.StatusTryAgainLater, err.Error())
 		return err
 	}
 
-	// build message with id
-	idMsg, err := json.Marshal(c.player.PlayerId)
+	c.game = g
+
+	if err := s.welcome(ctx, c); err != nil {
+		// the player never learnt its id, so it can never come back for its spot
+		g.disconnectPlayer(c.player.PlayerId)
+		return err
+	}
+
+	// public lobbies start as soon as they fill up, private ones wait for the host
+	// the next player then opens a new public lobby
+	if g == s.nextGame && g.readyToStart() {
+		g.start()
+	}
+
+	s.startClient(c)
+
+	return nil
+}
+
+// reconnect reattaches a websocket connection to a disconnected player presenting its resume token
+func (s *server) reconnect(ctx context.Context, conn *websocket.Conn, playerId string, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the previous connection may still look alive, half-open until the heartbeat notices
+	previous, isStale := s.staleClients[playerId]
+	if !isStale {
+		previous = s.clients[playerId]
+	}
+	if previous == nil || subtle.ConstantTimeCompare([]byte(previous.resumeToken), []byte(token)) != 1 {
+		err := fmt.Errorf("unable to resume session of player %v", playerId)
+		conn.Close(websocket.StatusPolicyViolation, err.Error())
+		return err
+	}
+
+	if isStale {
+		previous.staleTimer.Stop()
+		delete(s.staleClients, playerId)
+	} else {
+		// the token proves who the player is, so the new connection takes over,
+		// without waiting on a close handshake the old peer may never answer
+		InfoLogger.Println("Taking over connection of player:", playerId)
+		go previous.conn.Close(websocket.StatusNormalClosure, "Session resumed from another connection")
+		s.detachClient(previous)
+	}
+
+	// a game that is over has nothing left to resume
+	if _, ok := s.games.games[previous.game.GameId]; !ok || previous.game.finished() {
+		err := fmt.Errorf("game of player %v is over", playerId)
+		conn.Close(websocket.StatusNormalClosure, err.Error())
+		return err
+	}
+
+	c := &client{
+		player:      previous.player,
+		game:        previous.game,
+		resumeToken: previous.resumeToken,
+		mailbox:     newMailbox(),
+		limiter:     newRateLimiter(),
+		conn:        conn,
+		binary:      conn.Subprotocol() == SUBPROTOCOL_MSGPACK,
+		staleUntil:  previous.staleUntil,
+	}
+
+	InfoLogger.Println("Reconnect player:", playerId)
+
+	// the new connection starts over from a full snapshot
+	c.game.resetViews(playerId)
+
+	if err := s.welcome(ctx, c); err != nil {
+		// the player may still try again until the original grace period is over
+		s.expireLater(c)
+		return err
+	}
+
+	// the grace period starts over the next time the connection drops
+	c.staleUntil = time.Time{}
+	s.startClient(c)
+	s.resumeIfReady(c.game)
+
+	return nil
+}
+
+// welcome registers a client and informs it of its id and resume token, assuming the lock is held
+func (s *server) welcome(ctx context.Context, c *client) error {
+	// build messages with id and resume token
+	idMsg, err := encodeMessage(c.binary, c.player.PlayerId)
+	if err != nil {
+		c.conn.Close(websocket.StatusTryAgainLater, err.Error())
+		return err
+	}
+
+	resumeMsg, err := encodeMessage(c.binary, resumeMessage{ResumeToken: c.resumeToken})
 	if err != nil {
-		close(c.out)
 		c.conn.Close(websocket.StatusTryAgainLater, err.Error())
 		return err
 	}
 
-	c.game = s.nextGame
 	s.clients[c.player.PlayerId] = c
+	c.game.setBinary(c.player.PlayerId, c.binary)
 
-	// inform client of its id
-	if err := writeTimeout(ctx, 1*time.Second, conn, []byte(idMsg)); err != nil {
-		close(c.out)
+	// inform client of its id and resume token
+	if err := writeTimeout(ctx, 1*time.Second, c.conn, c.binary, idMsg); err != nil {
 		delete(s.clients, c.player.PlayerId)
 		c.conn.Close(websocket.StatusPolicyViolation, err.Error())
 		return err
 	}
 
-	if s.nextGame.readyToStart() {
-		s.nextGame.start()
-		s.nextGame = newGame(s.inbox)
+	if err := writeTimeout(ctx, 1*time.Second, c.conn, c.binary, resumeMsg); err != nil {
+		delete(s.clients, c.player.PlayerId)
+		c.conn.Close(websocket.StatusPolicyViolation, err.Error())
+		return err
 	}
 
+	return nil
+}
+
+// startClient spins up the reader and writer goroutines of a client
+func (s *server) startClient(c *client) {
 	rwCtx, cancel := context.WithCancel(context.Background())
 
 	c.rwTerminate = cancel
 
-	c.rwWg.Add(2)
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+
+	c.rwWg.Add(3)
 
 	go s.clientReader(rwCtx, c)
 	go s.clientWriter(rwCtx, c)
+	go s.clientHeartbeat(rwCtx, c)
+}
 
-	return nil
+// newResumeToken generates the secret a client presents to resume its session
+func newResumeToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// findLobby returns the game a connecting player joins, assuming the lock is held:
+// a new private lobby, the private lobby with the given code, or the public lobby
+func (s *server) findLobby(code string, create bool) (*game, error) {
+	if create {
+		g, err := s.createGame()
+		if err != nil {
+			return nil, err
+		}
+
+		code := s.newLobbyCode()
+		g.setCode(code)
+		s.lobbies[code] = g
+
+		InfoLogger.Println("Created private lobby:", code, g.GameId)
+
+		return g, nil
+	}
+
+	if code != "" {
+		code = strings.ToUpper(code)
+		g, ok := s.lobbies[code]
+		if ok && !g.inLobby() {
+			delete(s.lobbies, code)
+			ok = false
+		}
+		if !ok {
+			return nil, fmt.Errorf("no open lobby with code %v", code)
+		}
+		return g, nil
+	}
+
+	// the host may have started the public lobby before it filled up
+	if !s.nextGame.inLobby() {
+		nextGame, err := s.createGame()
+		if err != nil {
+			return nil, err
+		}
+		s.nextGame = nextGame
+	}
+
+	return s.nextGame, nil
+}
+
+// newLobbyCode generates a short join code not used by any open lobby, assuming the lock is held
+func (s *server) newLobbyCode() string {
+	code := make([]byte, LOBBY_CODE_LENGTH)
+	for {
+		for i := range code {
+			code[i] = LOBBY_CODE_ALPHABET[mathrand.Intn(len(LOBBY_CODE_ALPHABET))]
+		}
+		if _, ok := s.lobbies[string(code)]; !ok {
+			return string(code)
+		}
+	}
 }
 
 // clientReader loops reading messages from a client
@@ -218,7 +462,7 @@ func (s *server) clientReader(ctx context.Context, c *client) {
 	}()
 
 	for {
-		a, err := readTimeout(ctx, 1*time.Second, c.conn)
+		a, err := readAction(ctx, c.conn, c.binary)
 		if websocket.CloseStatus(err) == websocket.StatusNormalClosure ||
 			websocket.CloseStatus(err) == websocket.StatusGoingAway {
 			return
@@ -227,17 +471,69 @@ func (s *server) clientReader(ctx context.Context, c *client) {
 			WarnLogger.Println("clientReader:", c.player.PlayerId, err.Error())
 			return
 		}
-		select {
-		case c.game.inbox <- &gameUpdate{
-			action: a,
-		}:
-			// ok
-		case <-ctx.Done():
-			InfoLogger.Println("Context done on clientReader:", c.player.PlayerId)
-			// in case the game ends, the server forces the disconnection
+
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+
+		if a == nil {
+			continue
+		}
+
+		// actions always belong to the player on this connection
+		received := time.Now()
+		a.PlayerId = c.player.PlayerId
+
+		switch c.limiter.allow(a, received) {
+		case RATE_DISCONNECT:
+			WarnLogger.Println("Connection flooding actions:", c.player.PlayerId)
+			c.conn.Close(websocket.StatusPolicyViolation, "Sending actions too fast")
 			return
+		case RATE_WARN:
+			WarnLogger.Println("Connection over its action rate:", c.player.PlayerId)
+			fallthrough
+		case RATE_DROP:
+			dropped(c, a, REJECT_RATE_LIMITED)
+			continue
 		}
+
+		u := &gameUpdate{
+			action: a,
+		}
+
+		if a.Pong != nil {
+			c.clock.addSample(a.Pong.Ping.Time, a.Pong.Time.Time, received)
+			estimate := c.clock
+			u.clock = &estimate
+		}
+
+		// validation only ever sees server time
+		a.Timestamp = Time{c.clock.toServer(a.Timestamp.Time, received)}
+
+		superseded, ok := c.game.inputs.push(u)
+		if !ok {
+			WarnLogger.Println("Input queue full:", c.player.PlayerId)
+			dropped(c, a, REJECT_QUEUE_FULL)
+		} else if superseded != nil {
+			dropped(c, superseded.action, REJECT_SUPERSEDED)
+		}
+	}
+}
+
+// dropped tells a client its action was never handed to the game, if it asked for a reply
+func dropped(c *client, a *Action, reason RejectReason) {
+	if a.ActionId == 0 {
+		return
+	}
+
+	msg, err := encodeMessage(c.binary, ActionReply{
+		ActionId: a.ActionId,
+		Errors:   []Rejection{{Action: "Action", Reason: reason}},
+	})
+	if err != nil {
+		ErrorLogger.Println("dropped failed to marshall action reply:", err)
+		return
 	}
+
+	c.mailbox.push(message{content: msg})
 }
 
 // clientWriter loops writing messages to a client
@@ -250,25 +546,82 @@ func (s *server) clientWriter(ctx context.Context, c *client) {
 		// c.conn.Close(websocket.StatusNormalClosure, "")
 	}()
 
+	pingTicker := time.NewTicker(CLOCK_SYNC_INTERVAL)
+	defer pingTicker.Stop()
+
+	if err := writePing(ctx, s.config.StarvationDeadline, c); err != nil {
+		WarnLogger.Println("clientWriter:", c.player.PlayerId, err)
+		return
+	}
+
 	for {
 		select {
-		case msg := <-c.out:
-			err := writeTimeout(ctx, 1*time.Second, c.conn, msg.content)
-			if websocket.CloseStatus(err) == websocket.StatusNormalClosure ||
-				websocket.CloseStatus(err) == websocket.StatusGoingAway {
+		case <-pingTicker.C:
+			if err := writePing(ctx, s.config.StarvationDeadline, c); err != nil {
+				WarnLogger.Println("clientWriter:", c.player.PlayerId, err)
 				return
 			}
+		case <-c.mailbox.ready:
+			for {
+				msg, ok := c.mailbox.pop()
+				if !ok {
+					break
+				}
+
+				// a client that reads nothing for this long is too slow to keep playing
+				err := writeTimeout(ctx, s.config.StarvationDeadline, c.conn, c.binary, msg.content)
+				if websocket.CloseStatus(err) == websocket.StatusNormalClosure ||
+					websocket.CloseStatus(err) == websocket.StatusGoingAway {
+					return
+				}
+				if err != nil {
+					WarnLogger.Println("clientWriter:", c.player.PlayerId, err)
+					return
+				}
+				if msg.last {
+					InfoLogger.Println("clientWriter has last message:", c.player.PlayerId)
+					return
+				}
+			}
+		case <-ctx.Done():
+			InfoLogger.Println("Context done on clientWriter:", c.player.PlayerId)
+			// in case the game ends, the server forces the disconnection
+			return
+		}
+	}
+}
+
+// clientHeartbeat pings a client to detect dead connections, and drops it if it stays idle for too long
+func (s *server) clientHeartbeat(ctx context.Context, c *client) {
+	defer func() {
+		c.rwWg.Done()
+		WarnLogger.Println("clientHeartbeat is closing", c.player.PlayerId)
+		go s.deleteClient(c, false)
+	}()
+
+	ticker := time.NewTicker(s.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// pongs are handled by the reader, so this only returns once the client answered
+			pingCtx, cancel := context.WithTimeout(ctx, s.config.HeartbeatTimeout)
+			err := c.conn.Ping(pingCtx)
+			cancel()
 			if err != nil {
-				WarnLogger.Println("clientWriter:", c.player.PlayerId, err)
+				WarnLogger.Println("clientHeartbeat:", c.player.PlayerId, err)
 				return
 			}
-			if msg.last {
-				InfoLogger.Println("clientWriter has last message:", c.player.PlayerId)
+
+			lastRead := time.Unix(0, atomic.LoadInt64(&c.lastRead))
+			if s.config.IdleTimeout > 0 && time.Since(lastRead) > s.config.IdleTimeout {
+				WarnLogger.Println("Connection idle:", c.player.PlayerId)
+				c.conn.Close(websocket.StatusPolicyViolation, "Connection idle for too long")
 				return
 			}
 		case <-ctx.Done():
-			InfoLogger.Println("Context done on clientWriter:", c.player.PlayerId)
-			// in case the game ends, the server forces the disconnection
+			InfoLogger.Println("Context done on clientHeartbeat:", c.player.PlayerId)
 			return
 		}
 	}
@@ -277,15 +630,36 @@ func (s *server) clientWriter(ctx context.Context, c *client) {
 // watch listens to server updates from other threads and broadcasts them to appropriate players
 func (s *server) watch() {
 	for u := range s.inbox {
-		s.broadcastMessage(message{content: u.gameState, last: u.endgame != nil}, u.playerIds)
+		// replies come first, so clients learn the fate of their actions before seeing their effects
+		for len(u.replies) > 0 {
+			replies := make(map[string]message, len(u.replies))
+			for playerId, queued := range u.replies {
+				replies[playerId] = message{content: queued[0]}
+				if len(queued) > 1 {
+					u.replies[playerId] = queued[1:]
+				} else {
+					delete(u.replies, playerId)
+				}
+			}
+			s.broadcastMessage(replies)
+		}
+
+		playerIds := make([]string, 0, len(u.gameStates))
+		msgs := make(map[string]message, len(u.gameStates))
+		for playerId, gameState := range u.gameStates {
+			playerIds = append(playerIds, playerId)
+			msgs[playerId] = message{content: gameState, snapshot: true, last: u.endgame != nil}
+		}
+
+		s.broadcastMessage(msgs)
 		if u.endgame != nil {
-			InfoLogger.Println("Going to end game for players:", u.playerIds)
-			s.endGameForPlayers(u.playerIds, u.endgame)
+			InfoLogger.Println("Going to end game for players:", playerIds)
+			go s.endGameForPlayers(playerIds, u.endgame)
 		}
 	}
 }
 
-// endGame
+// endGameForPlayers waits for the clients of a finished game to receive its last state, then retires the game
 func (s *server) endGameForPlayers(playerIds []string, game *game) {
 	clients := make([]*client, 0, len(playerIds))
 
@@ -299,30 +673,39 @@ func (s *server) endGameForPlayers(playerIds []string, game *game) {
 	}
 	s.mu.Unlock()
 
-	for _, c := range clients {
-		c.rwWg.Wait()
+	// a client stuck writing must not keep the game around, and counted against the limit, forever
+	delivered := make(chan struct{})
+	go func() {
+		for _, c := range clients {
+			c.rwWg.Wait()
+		}
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+	case <-time.After(END_GAME_TIMEOUT):
+		WarnLogger.Println("End game for players: gave up waiting for clients of game", game.GameId)
 	}
 
-	InfoLogger.Println("Sending quit game:", game.GameId)
-	game.inbox <- &gameUpdate{quit: true}
+	s.mu.Lock()
+	s.retireGame(game)
+	s.mu.Unlock()
 }
 
-// broadcastMessage sends a message the specified clients
-func (s *server) broadcastMessage(msg message, playerIds []string) {
+// broadcastMessage sends each specified client its own message
+func (s *server) broadcastMessage(msgs map[string]message) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// s.rateLimiter.Wait(context.Background())
-
-	for _, playerId := range playerIds {
+	for playerId, msg := range msgs {
+		if _, ok := s.staleClients[playerId]; ok {
+			// the client may still reconnect
+			continue
+		}
 		if client, ok := s.clients[playerId]; ok {
-			select {
-			case client.out <- msg:
-			default:
-				WarnLogger.Println("Connection too slow:", playerId)
-				client.conn.Close(websocket.StatusPolicyViolation, "Connection too slow to keep up with messages")
-				go s.deleteClient(client, false)
-			}
+			// slow clients skip stale snapshots, and are only dropped by their writer once they stop reading altogether
+			client.mailbox.push(msg)
 		} else {
 			WarnLogger.Println("Broadcast: client", playerId, "not found")
 		}
@@ -338,53 +721,105 @@ func (s *server) deleteClient(c *client, permanent bool) {
 	// close socket if not yet closed
 	c.conn.Close(websocket.StatusNormalClosure, "")
 
-	// remove client from set of running clients
-	if _, ok := s.clients[c.player.PlayerId]; ok {
-		delete(s.clients, c.player.PlayerId)
-	} else {
+	// remove client from set of running clients, unless it has already been replaced by a reconnection
+	if current, ok := s.clients[c.player.PlayerId]; !ok || current != c {
 		return
 	}
 
-	// mark client as disconnected
-	c.disconnected = true
+	s.detachClient(c)
 
-	if !permanent {
-		// TODO: take care of client being able to reconnect
-		//       spun up a thread to wait for reconnection
+	// keep the player in the game for a while in case the client reconnects
+	if !permanent && !c.game.finished() {
+		InfoLogger.Println("Waiting for player to reconnect:", c.player.PlayerId)
+		s.expireLater(c)
+		return
 	}
 
+	go removeClientFromGame(c)
+}
+
+// detachClient removes a running client, whose socket is closed, and waits for its goroutines to finish,
+// assuming the lock is held
+func (s *server) detachClient(c *client) {
+	delete(s.clients, c.player.PlayerId)
+
+	// mark client as disconnected
+	c.disconnected = true
+
 	// wait for reader and writer goroutines to finish
 	c.rwTerminate()
 	c.rwWg.Wait()
+}
 
-	// close channel as writer goroutine is no longer running
-	close(c.out)
+// expireLater marks a client as stale until the reconnection grace period is over, assuming the lock is held
+func (s *server) expireLater(c *client) {
+	if c.staleUntil.IsZero() {
+		c.staleUntil = time.Now().Add(RECONNECT_GRACE)
+	}
 
-	go removeClientFromGame(c)
+	s.staleClients[c.player.PlayerId] = c
+	c.staleTimer = time.AfterFunc(time.Until(c.staleUntil), func() {
+		s.mu.Lock()
+		if s.staleClients[c.player.PlayerId] != c {
+			s.mu.Unlock()
+			return
+		}
+		delete(s.staleClients, c.player.PlayerId)
+		s.mu.Unlock()
+
+		InfoLogger.Println("Reconnection grace period over:", c.player.PlayerId)
+		removeClientFromGame(c)
+	})
 }
 
 func removeClientFromGame(c *client) {
-	if !c.game.inEndOfGame() {
+	if !c.game.finished() {
 		c.game.inbox <- &gameUpdate{
 			disconnect: &c.player.PlayerId,
 		}
 	}
 }
 
-// writeTimeout reads a message from a websocket with a timeout
-func readTimeout(ctx context.Context, timeout time.Duration, conn *websocket.Conn) (*Action, error) {
-	ctx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
+// writePing sends a clock synchronization ping stamped with the server time
+func writePing(ctx context.Context, timeout time.Duration, c *client) error {
+	msg, err := encodeMessage(c.binary, Ping{Ping: Time{time.Now()}})
+	if err != nil {
+		return err
+	}
+	return writeTimeout(ctx, timeout, c.conn, c.binary, msg)
+}
+
+// readAction reads an action from a websocket, waiting for as long as the context allows
+func readAction(ctx context.Context, conn *websocket.Conn, binary bool) (*Action, error) {
+	typ, msg, err := conn.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary {
+		if typ != websocket.MessageBinary {
+			return nil, fmt.Errorf("expected binary message but got: %v", typ)
+		}
+		if msg, err = msgpackToJSON(msg); err != nil {
+			return nil, err
+		}
+	} else if typ != websocket.MessageText {
+		return nil, fmt.Errorf("expected text message but got: %v", typ)
+	}
 
 	var a *Action
-	err := wsjson.Read(ctx, conn, &a)
+	err = json.Unmarshal(msg, &a)
 	return a, err
 }
 
-// writeTimeout writes a message to a websocket with a timeout
-func writeTimeout(ctx context.Context, timeout time.Duration, conn *websocket.Conn, msg []byte) error {
+// writeTimeout writes a message, already encoded for the client's protocol, to a websocket with a timeout
+func writeTimeout(ctx context.Context, timeout time.Duration, conn *websocket.Conn, binary bool, msg []byte) error {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
+	if binary {
+		return conn.Write(ctx, websocket.MessageBinary, msg)
+	}
+
 	return conn.Write(ctx, websocket.MessageText, msg)
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// testConfig configures a server that neither announces nor checkpoints itself
+func testConfig() serverConfig {
+	config := DEFAULT_SERVER_CONFIG
+	config.Discovery = DISCOVERY_NONE
+	config.CheckpointInterval = 0
+	return config
+}
+
+// testServer runs a server, and returns its connect url
+func testServer(t *testing.T, config serverConfig) (*server, string) {
+	s, err := newServer(0, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	return s, "ws" + strings.TrimPrefix(ts.URL, "http") + "/connect"
+}
+
+// dial connects to a server and reads the player id and resume token it is welcomed with
+func dial(t *testing.T, ctx context.Context, u string) (*websocket.Conn, string, string) {
+	conn, _, err := websocket.Dial(ctx, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var playerId string
+	var resume resumeMessage
+	for _, v := range []interface{}{&playerId, &resume} {
+		_, msg, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(msg, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return conn, playerId, resume.ResumeToken
+}
+
+// TestResumeTakesOver checks that a player resuming while the server still holds its previous
+// connection takes that connection over, instead of being turned away
+func TestResumeTakesOver(t *testing.T) {
+	s, u := testServer(t, testConfig())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	old, playerId, token := dial(t, ctx, u+"?name=player")
+	defer old.Close(websocket.StatusNormalClosure, "")
+
+	conn, resumedId, _ := dial(t, ctx, u+"?id="+url.QueryEscape(playerId)+"&token="+url.QueryEscape(token))
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	if resumedId != playerId {
+		t.Fatalf("resumed as %v instead of %v", resumedId, playerId)
+	}
+
+	s.mu.Lock()
+	c, ok := s.clients[playerId]
+	s.mu.Unlock()
+	if !ok || c.disconnected {
+		t.Fatal("resumed client is not running")
+	}
+
+	// the old connection is cut off, whether or not its peer would answer a close handshake
+	for {
+		if _, _, err := old.Read(ctx); err != nil {
+			if ctx.Err() != nil {
+				t.Fatal("old connection was never closed")
+			}
+			break
+		}
+	}
+}
+
+// TestFailedWelcome checks that a player who could not be told its id does not keep its spot in the lobby
+func TestFailedWelcome(t *testing.T) {
+	s, _ := testServer(t, testConfig())
+
+	// a cancelled context makes the first write of the welcome fail
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	handled := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(handled)
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := s.connect(ctx, conn, "player", "", false); err == nil {
+			t.Error("welcome did not fail")
+		}
+	}))
+	defer ts.Close()
+
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer dialCancel()
+	conn, _, err := websocket.Dial(dialCtx, "ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	<-handled
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := s.nextGame.connectedPlayers(); n != 0 {
+		t.Fatalf("%d players still connected to the lobby", n)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+type GameSettings struct {
+	MinPlayers         int
+	MaxPlayers         int
+	NumImpostors       int
+	TasksToWin         int
+	MoveSpeed          float64
+	KillRange          float64
+	TaskRange          float64
+	ReportRange        float64
+	VisionRange        float64
+	TaskDuration       Duration
+	KillCooldown       Duration
+	EmergencyMeetings  int
+	DiscussionDuration Duration
+	VotingDuration     Duration
+	ResultsDuration    Duration
+
+	// players send input directions instead of positions
+	AuthoritativeMovement bool
+}
+
+// Duration is sent to clients as a number of seconds.
+type Duration struct {
+	time.Duration
+}
+
+var DEFAULT_SETTINGS = GameSettings{
+	MinPlayers:         5,
+	MaxPlayers:         10,
+	NumImpostors:       2,
+	TasksToWin:         len(TASKS),
+	MoveSpeed:          120.0,
+	KillRange:          30.0,
+	TaskRange:          60.0,
+	ReportRange:        60.0,
+	VisionRange:        250.0,
+	TaskDuration:       Duration{5 * time.Second},
+	KillCooldown:       Duration{25 * time.Second},
+	EmergencyMeetings:  1,
+	DiscussionDuration: Duration{15 * time.Second},
+	VotingDuration:     Duration{30 * time.Second},
+	ResultsDuration:    Duration{5 * time.Second},
+}
+
+// validate checks that a game can be played with the given settings
+func (s *GameSettings) validate() error {
+	if s.MaxPlayers < 2 || s.MaxPlayers > len(COLORS) {
+		return fmt.Errorf("max players must be between 2 and %d: %d", len(COLORS), s.MaxPlayers)
+	}
+
+	if s.NumImpostors < 1 || 2*s.NumImpostors >= s.MaxPlayers {
+		return fmt.Errorf("impostors must be at least 1 and fewer than half of the players: %d", s.NumImpostors)
+	}
+
+	if s.MinPlayers <= 2*s.NumImpostors || s.MinPlayers > s.MaxPlayers {
+		return fmt.Errorf("min players must be more than twice the impostors and at most max players: %d", s.MinPlayers)
+	}
+
+	if s.TasksToWin < 1 || s.TasksToWin > len(TASKS) {
+		return fmt.Errorf("tasks to win must be between 1 and %d: %d", len(TASKS), s.TasksToWin)
+	}
+
+	if s.MoveSpeed <= 0 || s.KillRange <= 0 || s.TaskRange <= 0 || s.ReportRange <= 0 || s.VisionRange <= 0 {
+		return fmt.Errorf("speeds and ranges must be positive")
+	}
+
+	if s.TaskDuration.Duration < 0 || s.KillCooldown.Duration < 0 || s.DiscussionDuration.Duration < 0 ||
+		s.VotingDuration.Duration <= 0 || s.ResultsDuration.Duration < 0 {
+		return fmt.Errorf("durations must not be negative and voting must take some time")
+	}
+
+	if s.EmergencyMeetings < 0 {
+		return fmt.Errorf("emergency meetings must not be negative: %d", s.EmergencyMeetings)
+	}
+
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(b, &seconds); err != nil {
+		return err
+	}
+	// rounded so that durations survive being sent back and forth
+	d.Duration = time.Duration(math.Round(seconds * float64(time.Second)))
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Seconds())
+}
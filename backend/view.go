@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const VISION_STEP = 5.0
+
+// snapshot holds the pieces of a game state marshalled once per update, so that
+// every recipient's view can be assembled without marshalling the state again
+type snapshot struct {
+	encoded
+	tick   uint64
+	tasks  map[string]Task
+	sight  map[[2]string]bool
+	vision float64
+	// the same pieces as MessagePack, when some player uses the binary protocol
+	packed *encoded
+}
+
+// encoded holds the pieces of a snapshot in one encoding
+type encoded struct {
+	header    map[string][]byte
+	taskBytes []byte
+	timestamp []byte
+	keys      map[string][]byte
+	self      map[string][]byte
+	revealed  map[string][]byte
+	hidden    map[string][]byte
+	bodies    map[string][]byte
+}
+
+// frame is the game state as seen by one player at one tick, kept to encode deltas against:
+// their own Player, and a playerView of everyone else in sight
+type frame struct {
+	tick     uint64
+	header   map[string][]byte
+	tasks    map[string]Task
+	players  map[string]interface{}
+	revealed map[string]bool
+	bodyIds  []string
+	bodies   []byte
+}
+
+// playerView is what a player gets to see of another player, without the fields only they need
+type playerView struct {
+	PlayerId    string
+	Name        string
+	Color       string
+	IsAlive     bool
+	IsImpostor  bool
+	IsConnected bool
+	Position    Vector
+	Direction   Vector
+	LastHeard   Time
+}
+
+func (p *Player) view() playerView {
+	return playerView{
+		PlayerId:    p.PlayerId,
+		Name:        p.Name,
+		Color:       p.Color,
+		IsAlive:     p.IsAlive,
+		IsImpostor:  p.IsImpostor,
+		IsConnected: p.IsConnected,
+		Position:    p.Position,
+		Direction:   p.Direction,
+		LastHeard:   p.LastHeard,
+	}
+}
+
+// HEADER_FIELDS lists the game state fields sent whole whenever they change
+var HEADER_FIELDS = []string{"GameId", "Code", "HostId", "Status", "Meeting", "Settings"}
+
+// newSnapshot marshals the shared parts of the game state, assuming the lock is held
+func (g *game) newSnapshot(tick uint64, packed bool) (*snapshot, error) {
+	s := &snapshot{
+		tick:   tick,
+		tasks:  make(map[string]Task, len(g.Tasks)),
+		sight:  make(map[[2]string]bool),
+		vision: g.Settings.VisionRange,
+	}
+
+	for taskId, task := range g.Tasks {
+		s.tasks[taskId] = *task
+	}
+
+	e, err := g.encodePieces(json.Marshal)
+	if err != nil {
+		return nil, err
+	}
+	s.encoded = *e
+
+	if packed {
+		if s.packed, err = g.encodePieces(msgpackMarshal); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// encodePieces marshals every piece of the game state a view is assembled from, assuming the lock is held
+func (g *game) encodePieces(marshal func(interface{}) ([]byte, error)) (*encoded, error) {
+	e := &encoded{
+		header:   make(map[string][]byte, len(HEADER_FIELDS)),
+		keys:     make(map[string][]byte, len(g.Players)),
+		self:     make(map[string][]byte, len(g.Players)),
+		revealed: make(map[string][]byte, len(g.Players)),
+		hidden:   make(map[string][]byte, len(g.Players)),
+		bodies:   make(map[string][]byte, len(g.Bodies)),
+	}
+
+	var err error
+	fields := map[string]interface{}{
+		"GameId":   g.GameId,
+		"Code":     g.Code,
+		"HostId":   g.HostId,
+		"Status":   g.Status,
+		"Meeting":  g.Meeting,
+		"Settings": g.Settings,
+	}
+	for _, field := range HEADER_FIELDS {
+		if e.header[field], err = marshal(fields[field]); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.taskBytes, err = marshal(g.Tasks); err != nil {
+		return nil, err
+	}
+	if e.timestamp, err = marshal(g.Timestamp); err != nil {
+		return nil, err
+	}
+
+	for playerId, player := range g.Players {
+		if e.keys[playerId], err = marshal(playerId); err != nil {
+			return nil, err
+		}
+		if e.self[playerId], err = marshal(player); err != nil {
+			return nil, err
+		}
+		if e.revealed[playerId], err = marshal(player.view()); err != nil {
+			return nil, err
+		}
+		hidden := player.view()
+		hidden.IsImpostor = false
+		if e.hidden[playerId], err = marshal(hidden); err != nil {
+			return nil, err
+		}
+	}
+
+	for playerId, body := range g.Bodies {
+		if e.bodies[playerId], err = marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+// frame decides what a single player gets to see, assuming the lock is held
+func (s *snapshot) frame(g *game, viewer *Player) *frame {
+	f := &frame{
+		tick:     s.tick,
+		header:   s.header,
+		tasks:    s.tasks,
+		players:  make(map[string]interface{}, len(g.Players)),
+		revealed: make(map[string]bool, len(g.Players)),
+	}
+
+	for playerId, player := range g.Players {
+		if !s.canSee(g, viewer, player) {
+			continue
+		}
+		if player == viewer {
+			f.revealed[playerId] = true
+			f.players[playerId] = *player
+			continue
+		}
+		seen := player.view()
+		f.revealed[playerId] = canKnowRole(g, viewer, player)
+		if !f.revealed[playerId] {
+			seen.IsImpostor = false
+		}
+		f.players[playerId] = seen
+	}
+
+	for playerId, body := range g.Bodies {
+		if g.Status == IN_PROGRESS && viewer.IsAlive && !s.inSight(viewer.PlayerId, viewer.Position, playerId, body.Position) {
+			continue
+		}
+		f.bodyIds = append(f.bodyIds, playerId)
+	}
+	// the same bodies must encode the same, for deltas to leave them out
+	sort.Strings(f.bodyIds)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, playerId := range f.bodyIds {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(s.keys[playerId])
+		buf.WriteByte(':')
+		buf.Write(s.bodies[playerId])
+	}
+	buf.WriteByte('}')
+	f.bodies = buf.Bytes()
+
+	return f
+}
+
+// view assembles the full game state as seen by a single player, assuming the lock is held
+func (s *snapshot) view(g *game, viewer *Player, f *frame, now time.Time) []byte {
+	var buf bytes.Buffer
+	buf.Grow(1024 + 256*len(f.players))
+
+	buf.WriteString(`{"Tick":`)
+	buf.WriteString(strconv.FormatUint(s.tick, 10))
+
+	for _, field := range HEADER_FIELDS {
+		buf.WriteString(`,"` + field + `":`)
+		buf.Write(s.header[field])
+	}
+
+	buf.WriteString(`,"Players":{`)
+	first := true
+	for playerId := range f.players {
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		buf.Write(s.keys[playerId])
+		buf.WriteByte(':')
+		buf.Write(s.player(&s.encoded, f, viewer, playerId))
+	}
+	buf.WriteByte('}')
+
+	buf.WriteString(`,"Tasks":`)
+	buf.Write(s.taskBytes)
+
+	buf.WriteString(`,"Bodies":`)
+	buf.Write(f.bodies)
+
+	buf.WriteString(`,"Timestamp":`)
+	buf.Write(s.timestamp)
+
+	if viewer.IsImpostor && !g.inEndOfGame() {
+		buf.WriteString(`,"KillCooldown":`)
+		buf.WriteString(strconv.FormatFloat(g.killCooldown(viewer.PlayerId, now), 'f', -1, 64))
+	}
+
+	buf.WriteByte('}')
+
+	return buf.Bytes()
+}
+
+// packedView assembles the same message as view, from the MessagePack pieces, assuming the lock is held
+func (s *snapshot) packedView(g *game, viewer *Player, f *frame, now time.Time) []byte {
+	var buf bytes.Buffer
+	buf.Grow(1024 + 256*len(f.players))
+
+	cooldown := viewer.IsImpostor && !g.inEndOfGame()
+	fields := 1 + len(HEADER_FIELDS) + 4
+	if cooldown {
+		fields++
+	}
+	msgpackEncodeLength(&buf, fields, 0x80, 15, 0, 0xde, 0xdf)
+
+	msgpackEncode(&buf, "Tick")
+	msgpackEncodeValue(&buf, reflect.ValueOf(s.tick))
+
+	for _, field := range HEADER_FIELDS {
+		msgpackEncode(&buf, field)
+		buf.Write(s.packed.header[field])
+	}
+
+	msgpackEncode(&buf, "Players")
+	msgpackEncodeLength(&buf, len(f.players), 0x80, 15, 0, 0xde, 0xdf)
+	for playerId := range f.players {
+		buf.Write(s.packed.keys[playerId])
+		buf.Write(s.player(s.packed, f, viewer, playerId))
+	}
+
+	msgpackEncode(&buf, "Tasks")
+	buf.Write(s.packed.taskBytes)
+
+	msgpackEncode(&buf, "Bodies")
+	buf.Write(s.packedBodies(f))
+
+	msgpackEncode(&buf, "Timestamp")
+	buf.Write(s.packed.timestamp)
+
+	if cooldown {
+		msgpackEncode(&buf, "KillCooldown")
+		msgpackEncodeValue(&buf, reflect.ValueOf(g.killCooldown(viewer.PlayerId, now)))
+	}
+
+	return buf.Bytes()
+}
+
+// player picks the encoding of a player in a frame: whole for the viewer, with or without their role for others
+func (s *snapshot) player(e *encoded, f *frame, viewer *Player, playerId string) []byte {
+	if playerId == viewer.PlayerId {
+		return e.self[playerId]
+	} else if f.revealed[playerId] {
+		return e.revealed[playerId]
+	}
+	return e.hidden[playerId]
+}
+
+// packedBodies encodes the bodies in a frame as MessagePack
+func (s *snapshot) packedBodies(f *frame) []byte {
+	var buf bytes.Buffer
+	msgpackEncodeLength(&buf, len(f.bodyIds), 0x80, 15, 0, 0xde, 0xdf)
+	for _, playerId := range f.bodyIds {
+		buf.Write(s.packed.keys[playerId])
+		buf.Write(s.packed.bodies[playerId])
+	}
+	return buf.Bytes()
+}
+
+// canSee decides whether a player appears in the viewer's snapshot
+func (s *snapshot) canSee(g *game, viewer *Player, target *Player) bool {
+	if viewer == target || g.Status != IN_PROGRESS || !viewer.IsAlive {
+		return true
+	}
+
+	// ghosts are only visible to other ghosts
+	if !target.IsAlive {
+		return false
+	}
+
+	return s.inSight(viewer.PlayerId, viewer.Position, target.PlayerId, target.Position)
+}
+
+// inSight checks range and line of sight between two points, caching the result by pair of ids
+func (s *snapshot) inSight(fromId string, from Vector, toId string, to Vector) bool {
+	key := [2]string{fromId, toId}
+	if toId < fromId {
+		key = [2]string{toId, fromId}
+	}
+	if visible, ok := s.sight[key]; ok {
+		return visible
+	}
+
+	visible := lineOfSight(from, to, s.vision)
+	s.sight[key] = visible
+	return visible
+}
+
+// canKnowRole decides whether the viewer is allowed to learn the target's role
+func canKnowRole(g *game, viewer *Player, target *Player) bool {
+	return viewer == target || g.inEndOfGame() || (viewer.IsImpostor && target.IsImpostor)
+}
+
+// lineOfSight checks that two points are within vision range and that every
+// point sampled along the segment between them lies on the navmesh
+func lineOfSight(from Vector, to Vector, visionRange float64) bool {
+	distanceSquared := from.squaredDistance(to)
+	if distanceSquared > math.Pow(visionRange, 2)+EPS {
+		return false
+	}
+
+	steps := int(math.Sqrt(distanceSquared) / VISION_STEP)
+	delta := to.sub(from)
+	for i := 1; i < steps; i++ {
+		point := from.add(delta.mul(float64(i) / float64(steps)))
+		if !checkNavmesh(&point) {
+			return false
+		}
+	}
+
+	return true
+}
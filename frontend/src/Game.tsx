@@ -87,8 +87,7 @@ const Game = (props: GameProps) => {
             position: [val.Position.X, val.Position.Y],
             direction: [val.Direction.X, val.Direction.Y],
             lastHeard: Date.parse(val.LastHeard),
-            driftFactor: val.DriftFactor,
-            drift: val.Drift,
+            drift: key === thisPlayerId ? -val.ClockOffset : 0,
           };
 
           if (key === thisPlayerId) {
@@ -112,9 +111,11 @@ const Game = (props: GameProps) => {
       const serverTimestamp = Date.parse(gameState.Timestamp);
 
       if (gameState.GameId === state.gameId) {
+        // the server only sends the players in sight, so anyone missing has left view
         const newState: IGameState = {
           ...state,
           timestamp: serverTimestamp,
+          otherPlayers: {},
         };
 
         Object.entries(gameState.Players).forEach(
@@ -125,10 +126,7 @@ const Game = (props: GameProps) => {
                 return state;
               }
 
-              const thisDrift =
-                (val.DriftFactor +
-                  (serverTimestamp.valueOf() - new Date().valueOf())) /
-                2;
+              const thisDrift = -val.ClockOffset;
 
               newState.thisPlayer = {
                 ...newState.thisPlayer,
@@ -136,18 +134,19 @@ const Game = (props: GameProps) => {
                 position: [val.Position.X, val.Position.Y],
                 direction: [val.Direction.X, val.Direction.Y],
                 lastHeard: Date.parse(val.LastHeard),
-                driftFactor: val.DriftFactor,
                 drift: thisDrift,
               };
             } else {
               newState.otherPlayers[key] = {
-                ...newState.otherPlayers[key],
+                playerId: val.PlayerId,
+                playerName: val.Name,
+                color: val.Color,
                 isAlive: val.IsAlive && val.IsConnected,
+                isImpostor: val.IsImpostor,
                 position: [val.Position.X, val.Position.Y],
                 direction: [val.Direction.X, val.Direction.Y],
                 lastHeard: Date.parse(val.LastHeard),
-                driftFactor: val.DriftFactor,
-                drift: val.Drift,
+                drift: 0,
               };
             }
           }
@@ -204,7 +203,6 @@ const Game = (props: GameProps) => {
         },
         Direction: currDir,
         Timestamp: new Date(),
-        Drift: state.thisPlayer.drift,
       };
 
       if (websocket?.current?.readyState === 1 && !!thisPlayerId) {
@@ -289,6 +287,21 @@ const Game = (props: GameProps) => {
           return;
         }
 
+        // Answer clock synchronization pings right away.
+        if (currState?.Ping) {
+          websocket?.current?.send(
+            JSON.stringify({
+              PlayerId: thisPlayerId,
+              Pong: {
+                Ping: currState.Ping,
+                Time: new Date(),
+              },
+              Timestamp: new Date(),
+            })
+          );
+          return;
+        }
+
         if (currState?.Status === 1) {
           if (gameStatus !== status.PLAYING) {
             setState(constructInitialGameState(currState));
@@ -378,7 +391,6 @@ const Game = (props: GameProps) => {
           Kill: null,
           Task: null,
           Timestamp: new Date(),
-          Drift: state.thisPlayer.drift,
         };
 
         if (websocket?.current?.readyState === 1 && !!thisPlayerId) {
@@ -421,7 +433,6 @@ const Game = (props: GameProps) => {
       PlayerId: thisPlayerId,
       Timestamp: new Date(),
       StartTask: taskId,
-      Drift: state.thisPlayer.drift,
     };
 
     if (websocket?.current?.readyState === 1 && !!thisPlayerId) {
@@ -436,7 +447,6 @@ const Game = (props: GameProps) => {
           PlayerId: thisPlayerId,
           Timestamp: new Date(),
           CompleteTask: taskId,
-          Drift: state.thisPlayer.drift,
         };
 
         if (websocket?.current?.readyState === 1 && !!thisPlayerId) {
@@ -461,7 +471,6 @@ const Game = (props: GameProps) => {
       PlayerId: thisPlayerId,
       Timestamp: new Date(),
       CancelTask: taskId,
-      Drift: state.thisPlayer.drift,
     };
 
     clearInterval(taskTimer.current);
@@ -476,7 +485,6 @@ const Game = (props: GameProps) => {
       PlayerId: thisPlayerId,
       Timestamp: new Date(),
       Kill: killedPlayerId,
-      Drift: state.thisPlayer.drift,
     };
 
     if (websocket?.current?.readyState === 1 && !!thisPlayerId) {
@@ -7,7 +7,10 @@ const Login = () => {
   const [servers, setServers] = useState([]);
 
   useEffect(() => {
-    fetch('http://catalog.cse.nd.edu:9097/query.json')
+    fetch(
+      process.env.REACT_APP_CATALOG_URL ||
+        'http://catalog.cse.nd.edu:9097/query.json'
+    )
       .then((response) => response.json())
       .then((data) => setServers(data));
   }, []);
@@ -15,7 +15,6 @@ export interface IPlayerState {
   position: [number, number];
   direction: [number, number];
   lastHeard: number;
-  driftFactor: number;
   drift: number;
 }
 
@@ -42,7 +41,6 @@ export const initialGameState: IGameState = {
     position: [0, 0],
     direction: [0, 0],
     lastHeard: new Date().valueOf(),
-    driftFactor: 0,
     drift: 0,
   },
   otherPlayers: {},
@@ -73,8 +73,7 @@ class TestClient:
             self.sendt = None
 
     def send(self, data, now):
-        data = data | {'PlayerId': self.id,
-                       'Timestamp': now, 'Drift': self.drift}
+        data = data | {'PlayerId': self.id, 'Timestamp': now}
         msg = DateTimeJSONEncoder().encode(data)
         self.last_message = now
         self.wsapp.send(msg)
@@ -142,13 +141,18 @@ class TestClient:
                 self.sendt.start()
                 return
 
+            if 'Ping' in message:
+                now = datetime.datetime.utcnow()
+                self.send({'Pong': {'Ping': message['Ping'], 'Time': now}}, now)
+                return
+
+            if 'Players' not in message:
+                return
+
             if self.id != None:
                 self.alive = message['Players'][self.id]['IsAlive']
 
-                serverTimestamp = datetime.datetime.strptime(
-                    message['Timestamp'], "%Y-%m-%dT%H:%M:%S.%f%z").timestamp() * 1000
-                self.drift = (message['Players'][self.id]['DriftFactor'] + (
-                    serverTimestamp - datetime.datetime.now().timestamp() * 1000))/2
+                self.drift = -message['Players'][self.id]['ClockOffset']
 
                 if message['Status'] == 1:
                     self.game_started = True
@@ -199,8 +203,8 @@ class TestClient:
                             new_update = datetime.datetime.strptime(
                                 player_now['LastHeard'], "%Y-%m-%dT%H:%M:%S.%f%z").timestamp() * 1000
 
-                            last_other_drift = player_before['Drift']
-                            new_other_drift = player_now['Drift']
+                            last_other_drift = 0
+                            new_other_drift = 0
 
                             last_duration = (
                                 self.last_position_update - (last_update + last_other_drift - self.drift)) / 1000.0